@@ -1,145 +1,345 @@
 package agent
 
 import (
+	"context"
+	"errors"
 	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sentineledge/agent/internal/bandwidth"
 	"github.com/sentineledge/agent/internal/communicator"
 	"github.com/sentineledge/agent/internal/executor"
 	"github.com/sentineledge/agent/internal/system"
-	"github.com/sentineledge/agent/internal/vault"
 	"github.com/sentineledge/agent/pkg/models"
-	"github.com/spf13/viper"
+	"golang.org/x/text/encoding"
 )
 
 type Agent struct {
-	config *Config
-	comm   *communicator.Communicator
+	config   *Config
+	codePage encoding.Encoding // salida legacy de los comandos; nil si no hay
+	comm     communicator.Transport
+	schedule *pollSchedule
+	push     communicator.CommandStream
+	longPoll *communicator.LongPoller
+	commands chan models.Command // comandos recibidos por push o long-poll
+	// reenrollRequests lleva al loop de Run los pedidos de registrarse de
+	// nuevo; solo Run cambia las credenciales de config, bajo mu, y las
+	// demás goroutines las leen con agentID
+	reenrollRequests chan string
+	// notFoundPolls cuenta los 404 seguidos del endpoint primario; solo lo
+	// toca tick
+	notFoundPolls int
+	// clonedFrom es el AgentID de la máquina original si esta es un clon
+	// que todavía no se registró
+	clonedFrom string
+
+	startedAt time.Time
+	outbox    atomic.Int32 // resultados pendientes de reportar
+	refused   atomic.Bool  // el servidor exige un protocolo más nuevo
+	skewAlert atomic.Bool  // el reloj está más corrido que el umbral
+	// inventoryDeferred indica que se salteó un inventario por enlace medido
+	inventoryDeferred atomic.Bool
+	// artifactsDeferred indica que hay artefactos apartados por enlace
+	// medido; uploadingDeferred evita dos subidas de los mismos a la vez
+	artifactsDeferred atomic.Bool
+	uploadingDeferred atomic.Bool
+
+	mu              sync.Mutex
+	jobs            map[string]string // job ID -> jobQueued / jobRunning
+	lastPollAt      time.Time
+	lastInventoryAt time.Time
+	lastEnrollAt    time.Time
 }
 
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+)
+
+// Modos de entrega de comandos
+const (
+	DeliveryPoll      = "poll"
+	DeliveryWebSocket = "websocket"
+	DeliveryLongPoll  = "longpoll"
+)
+
+// Tiempo que el servidor puede retener una petición de long-poll
+const longPollWait = 50 * time.Second
+
+// Con el canal push conectado el poll solo corre como red de seguridad
+const pushSafetyPoll = 5 * time.Minute
+
+// 404 seguidos en el poll a partir de los cuales el agente se da por borrado
+const notFoundThreshold = 3
+
 const (
 	OrgID       = "ebefd607-bd17-4a3f-aa01-4d1a28948ef5"
 	ColAgentsID = "d0f075e6-65d2-4f13-935c-e4d7a3dce261"
 	ColAPIID    = "056e9be8-69ac-4e5e-95a8-bcbf803824a3"
 )
 
+// New crea el agente con el transporte elegido en la configuración
 func New(cfg *Config) *Agent {
-	if cfg.AgentToken == "" || cfg.AgentID == "" {
-		log.Println("No token/ID — registering agent...")
-
-		resp, err := communicator.Register(cfg.ServerURL, cfg.TenantID, cfg.APIKey)
-		if err != nil {
-			log.Fatalf("Agent cannot be registered: %v", err)
-		}
+	comm, err := newTransport(cfg)
+	if err != nil {
+		log.Fatalf("Invalid transport configuration: %v", err)
+	}
+	return NewWithTransport(cfg, comm)
+}
 
-		cfg.AgentID = resp.ID
-		cfg.AgentToken = resp.Token
-
-		// Si hay Vault configurado, guardar token en Vaultwarden
-		if cfg.VaultURL != "" && cfg.VaultClientID != "" && cfg.VaultClientSecret != "" {
-			vc := vault.NewClient(cfg.VaultURL, cfg.VaultClientID, cfg.VaultClientSecret)
-			err := vc.StoreSecret(
-				"AGENT_TOKEN_"+resp.ID,
-				resp.Token,
-				OrgID,
-				ColAgentsID,
-			)
-			if err != nil {
-				log.Printf("StoreSecret error: %v", err)
-			} else {
-				log.Println("Token stored in Vaultwarden successfully")
-			}
-			if err != nil {
-				log.Printf("Warning: could not store token in vault: %v — saving to agent.yaml", err)
-				viper.Set("AgentID", resp.ID)
-				viper.Set("PollInterval", cfg.PollInterval)
-				viper.Set("ServerURL", cfg.ServerURL)
-				viper.Set("TenantID", cfg.TenantID)
-				viper.Set("VaultURL", cfg.VaultURL)
-				viper.Set("VaultClientID", cfg.VaultClientID)
-				viper.Set("VaultClientSecret", cfg.VaultClientSecret)
-				viper.WriteConfig()
-			} else {
-				log.Println("Token stored in Vaultwarden successfully")
-				// Solo guardar AgentID en agent.yaml, nunca el token
-				viper.Set("AgentID", resp.ID)
-				viper.Set("PollInterval", cfg.PollInterval)
-				viper.Set("ServerURL", cfg.ServerURL)
-				viper.Set("TenantID", cfg.TenantID)
-				viper.Set("VaultURL", cfg.VaultURL)
-				viper.Set("VaultClientID", cfg.VaultClientID)
-				viper.Set("VaultClientSecret", cfg.VaultClientSecret)
-				viper.WriteConfig()
-			}
-		} else {
-			// Sin Vault — guardar en agent.yaml como antes
-			viper.Set("AgentID", resp.ID)
-			viper.Set("PollInterval", cfg.PollInterval)
-			viper.Set("ServerURL", cfg.ServerURL)
-			viper.Set("TenantID", cfg.TenantID)
-			viper.Set("VaultURL", cfg.VaultURL)
-			viper.Set("VaultClientID", cfg.VaultClientID)
-			viper.Set("VaultClientSecret", cfg.VaultClientSecret)
-			viper.WriteConfig()
-		}
+// NewWithTransport crea el agente sobre un transporte ya armado, ej. un
+// commtest.Memory en pruebas. Si no hay credenciales, o las que hay son
+// de la máquina original de un clon, Run se registra antes de empezar.
+func NewWithTransport(cfg *Config, comm communicator.Transport) *Agent {
+	codePage, err := executor.LookupCodePage(cfg.OutputCodePage)
+	if err != nil {
+		log.Printf("Warning: %v — non UTF-8 output will be sent as base64", err)
 	}
 
-	comm := communicator.New(cfg.ServerURL, cfg.AgentToken, cfg.AgentID)
-	return &Agent{config: cfg, comm: comm}
+	return &Agent{
+		config:    cfg,
+		codePage:  codePage,
+		comm:      comm,
+		schedule:  newPollSchedule(time.Duration(cfg.PollInterval) * time.Second),
+		commands:  make(chan models.Command, 16),
+		startedAt: time.Now(),
+		jobs:      make(map[string]string),
+
+		reenrollRequests: make(chan string, 1),
+	}
 }
 
-func (a *Agent) Run() {
+// Run atiende al servidor hasta que se cancele ctx; al cancelarlo se
+// abortan las peticiones en curso y Run retorna
+func (a *Agent) Run(ctx context.Context) {
+	// La detección de clones y el registro van acá y no en New: main crea
+	// el agente también para install, start, stop y uninstall, que no
+	// deben tocar la identidad, y por file-drop la respuesta del registro
+	// puede tardar días y el servicio tiene que terminar de arrancar antes
+	a.clonedFrom = checkClone(a.config, a.comm)
+	if a.config.AgentToken == "" || a.config.AgentID == "" {
+		if !a.enroll(ctx) {
+			log.Println("Agent stopped")
+			return
+		}
+	}
+
 	log.Printf("Agent inicialized — ID: %s", a.config.AgentID)
-	log.Printf("Server: %s", a.config.ServerURL)
+	log.Printf("Server: %s", strings.Join(a.config.ServerURLs, ", "))
 	log.Printf("Poll every %d seconds", a.config.PollInterval)
 
+	// Canal push o long-poll; si no funcionan el poll por intervalo sigue
+	// igual. DeliveryMode elige el modo de HTTP: la suscripción MQTT y el
+	// watcher del file-drop arrancan siempre.
+	via := a.config.DeliveryMode
+	if a.config.pushTransport() {
+		via = a.config.Transport
+	}
+	switch {
+	case a.config.pushTransport() || a.config.DeliveryMode == DeliveryWebSocket:
+		if p, ok := a.comm.(communicator.Pusher); ok {
+			a.push = p.NewPush()
+			go a.push.Run(ctx, a.commands)
+		}
+	case a.config.DeliveryMode == DeliveryLongPoll:
+		lp, ok := a.comm.(communicator.LongPolling)
+		if !ok {
+			break
+		}
+		a.longPoll = lp.NewLongPoll(longPollWait)
+		go func() {
+			err := a.longPoll.Run(ctx, a.commands)
+			if errors.Is(err, communicator.ErrLongPollUnsupported) {
+				log.Printf("%v — using interval polling", err)
+			} else if err != nil {
+				a.handleError(ctx, err)
+			}
+		}()
+	}
+
 	// Poll inmediato al arrancar
-	a.tick()
+	a.tick(ctx)
 
 	// Inventory al arrancar
-	go a.collectAndSendInventory()
+	go a.scheduledInventory(ctx)
+
+	// Artefactos apartados antes de reiniciar; el heartbeat los sube
+	// cuando el enlace no es medido
+	a.recoverArtifacts()
 
-	// Ticker para poll de comandos
-	pollTicker := time.NewTicker(time.Duration(a.config.PollInterval) * time.Second)
-	defer pollTicker.Stop()
+	// Timer para poll de comandos; el intervalo varía según pollSchedule
+	pollTimer := time.NewTimer(a.schedule.next())
+	defer pollTimer.Stop()
 
 	// Ticker para inventory cada 24 horas
 	inventoryTicker := time.NewTicker(24 * time.Hour)
 	defer inventoryTicker.Stop()
 
+	// Ticker para heartbeat
+	heartbeatTicker := time.NewTicker(time.Duration(a.config.HeartbeatInterval) * time.Second)
+	defer heartbeatTicker.Stop()
+
+	// Rotación periódica del token
+	tokenTicker := newOptionalTicker(time.Duration(a.config.TokenRefreshHours) * time.Hour)
+	defer tokenTicker.Stop()
+
+	// Certificado cliente: obtenerlo si falta y renovarlo antes de que venza
+	go a.checkCertificate(ctx)
+	certTicker := time.NewTicker(certCheckInterval)
+	defer certTicker.Stop()
+
 	for {
 		select {
-		case <-pollTicker.C:
-			a.tick()
+		case <-ctx.Done():
+			a.waitReports()
+			log.Println("Agent stopped")
+			return
+		case <-pollTimer.C:
+			a.tick(ctx)
+			pollTimer.Reset(a.schedule.next())
+		case cmd := <-a.commands:
+			log.Printf("Command %s received via %s", cmd.ID, via)
+			a.dispatch(ctx, cmd)
+		case reason := <-a.reenrollRequests:
+			a.reenroll(ctx, reason)
 		case <-inventoryTicker.C:
-			go a.collectAndSendInventory()
+			go a.scheduledInventory(ctx)
+		case <-heartbeatTicker.C:
+			a.heartbeat(ctx)
+		case <-certTicker.C:
+			go a.checkCertificate(ctx)
+		case <-tokenTicker.C:
+			a.rotateToken(ctx)
 		}
 	}
 }
 
-func (a *Agent) tick() {
-	commands, err := a.comm.PollCommands()
+func (a *Agent) tick(ctx context.Context) {
+	// Con un protocolo viejo no se piden comandos; el heartbeat sigue para
+	// que el servidor vea la versión y se pueda reinstalar
+	if a.refused.Load() {
+		return
+	}
+
+	// El long-poll ya está preguntando de forma continua
+	if a.longPoll != nil && a.longPoll.Active() {
+		return
+	}
+	if a.push != nil && a.push.Connected() {
+		a.mu.Lock()
+		recent := time.Since(a.lastPollAt) < pushSafetyPoll
+		a.mu.Unlock()
+		if recent {
+			return
+		}
+	}
+
+	resp, err := a.comm.PollCommands(ctx)
 	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
 		log.Printf("Error in poll: %v", err)
+		if a.agentDeleted(err) {
+			a.notFoundPolls = 0
+			a.reenroll(ctx, "Server does not know agent "+a.config.AgentID)
+			a.schedule.failure(0)
+			return
+		}
+		a.schedule.failure(a.handleError(ctx, err))
 		return
 	}
 
-	if len(commands) == 0 {
+	a.notFoundPolls = 0
+	a.schedule.success(len(resp.Commands) > 0, resp.NextPoll)
+
+	a.mu.Lock()
+	a.lastPollAt = time.Now()
+	a.mu.Unlock()
+
+	if len(resp.Commands) == 0 {
 		return
 	}
 
-	log.Printf("%d command(s) recieved", len(commands))
+	log.Printf("%d command(s) recieved", len(resp.Commands))
 
-	for _, cmd := range commands {
-		cmdCopy := cmd
-		go func() {
-			a.executeCommand(cmdCopy)
-		}()
+	for _, cmd := range resp.Commands {
+		a.dispatch(ctx, cmd)
+	}
+}
+
+// agentDeleted decide si un error del poll significa que el servidor borró
+// el agente: si lo dice explícitamente, o tras notFoundThreshold 404
+// seguidos del endpoint primario. Un 404 suelto puede ser un deploy a
+// medias o un secundario desactualizado, y registrarse de nuevo cambia el
+// AgentID.
+func (a *Agent) agentDeleted(err error) bool {
+	if errors.Is(err, communicator.ErrAgentDeleted) {
+		return true
+	}
+	if !errors.Is(err, communicator.ErrNotFound) {
+		return false
+	}
+	if urls := a.config.ServerURLs; len(urls) > 1 &&
+		a.comm.ActiveEndpoint() != strings.TrimRight(strings.TrimSpace(urls[0]), "/") {
+		return false
+	}
+	a.notFoundPolls++
+	return a.notFoundPolls >= notFoundThreshold
+}
+
+// dispatch arranca el job salvo que ya se haya recibido por otra vía. Con
+// el protocolo rechazado no se ejecuta nada, llegue por poll o por push.
+func (a *Agent) dispatch(ctx context.Context, cmd models.Command) {
+	if a.refused.Load() {
+		log.Printf("Command %s ignored — server refused this agent's protocol", cmd.ID)
+		return
+	}
+	if !a.trackJob(cmd.ID) {
+		return
+	}
+	go a.executeCommand(ctx, cmd)
+}
+
+// newOptionalTicker retorna un ticker que nunca dispara si d <= 0
+func newOptionalTicker(d time.Duration) *time.Ticker {
+	if d > 0 {
+		return time.NewTicker(d)
+	}
+	t := time.NewTicker(time.Hour)
+	t.Stop()
+	return t
+}
+
+// trackJob registra el job como encolado. Retorna false si ya se conoce.
+func (a *Agent) trackJob(id string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.jobs[id]; ok {
+		return false
+	}
+	a.jobs[id] = jobQueued
+	return true
+}
+
+func (a *Agent) setJobState(id, state string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if state == "" {
+		delete(a.jobs, id)
+		return
 	}
+	a.jobs[id] = state
 }
 
-func (a *Agent) executeCommand(cmd models.Command) {
+func (a *Agent) executeCommand(ctx context.Context, cmd models.Command) {
 	log.Printf("Running job %s — type: %s", cmd.ID, cmd.Type)
+	a.setJobState(cmd.ID, jobRunning)
+	defer a.setJobState(cmd.ID, "")
 
 	// Usar ID del comando como JobID para el resultado
 	cmdForExecutor := models.Command{
@@ -149,23 +349,57 @@ func (a *Agent) executeCommand(cmd models.Command) {
 		Timeout: cmd.Timeout,
 	}
 
-	result := executor.Execute(cmdForExecutor)
+	artifactsDir, err := executor.NewArtifactsDir(a.artifactsDir())
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	} else {
+		defer os.RemoveAll(artifactsDir)
+	}
+
+	progress := newProgressThrottle(ctx, a.comm)
+	result := executor.ExecuteWithProgress(cmdForExecutor, a.codePage, artifactsDir, progress.push)
+	progress.stop()
 	result.JobID = cmd.ID
+	if artifactsDir != "" {
+		result.Artifacts, result.DeferredArtifacts = a.handleArtifacts(ctx, cmd.ID, artifactsDir)
+	}
 
-	if err := a.comm.ReportResult(result); err != nil {
-		log.Printf("Error reporting job %s: %v", cmd.ID, err)
+	// El job ya corrió: si el agente se está deteniendo igual se intenta
+	// entregar el resultado durante reportGrace
+	a.outbox.Add(1)
+	defer a.outbox.Add(-1)
+	reportCtx, cancel := withGrace(ctx, reportGrace)
+	defer cancel()
+	a.reportResult(reportCtx, result)
+}
+
+// scheduledInventory envía el inventario periódico salvo que el enlace sea
+// medido; en ese caso queda pendiente hasta que deje de serlo. El que pide
+// el servidor no espera.
+func (a *Agent) scheduledInventory(ctx context.Context) {
+	if bandwidth.Metered() {
+		if !a.inventoryDeferred.Swap(true) {
+			log.Println("Link is metered — deferring inventory")
+		}
+		return
 	}
+	a.collectAndSendInventory(ctx)
 }
 
-func (a *Agent) collectAndSendInventory() {
+func (a *Agent) collectAndSendInventory(ctx context.Context) {
 	log.Println("Collecting inventory...")
-	inv, err := system.CollectInventory(a.config.AgentID, a.config.Hostname)
+	inv, err := system.CollectInventory(a.agentID(), a.config.Hostname)
 	if err != nil {
 		log.Printf("Inventory collection error: %v", err)
 		return
 	}
-	if err := a.comm.SendInventory(inv); err != nil {
+	if err := a.comm.SendInventory(ctx, inv); err != nil {
 		log.Printf("Inventory send error: %v", err)
 		return
 	}
+
+	a.inventoryDeferred.Store(false)
+	a.mu.Lock()
+	a.lastInventoryAt = time.Now()
+	a.mu.Unlock()
 }
@@ -0,0 +1,425 @@
+package agent
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/sentineledge/agent/internal/bandwidth"
+	"github.com/sentineledge/agent/internal/communicator"
+	"github.com/sentineledge/agent/internal/communicator/commtest"
+	"github.com/sentineledge/agent/internal/system"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// newTestAgent arma un agente ya registrado sobre un transporte en memoria
+func newTestAgent(t *testing.T) (*Agent, *commtest.Memory) {
+	t.Helper()
+	mem := commtest.NewMemory()
+	cfg := &Config{
+		ServerURLs:        []string{"memory"},
+		AgentID:           "agent-1",
+		AgentToken:        "token-1",
+		APIKey:            "api-key",
+		PollInterval:      30,
+		HeartbeatInterval: 60,
+		DataDir:           t.TempDir(),
+		Fingerprint:       system.CollectFingerprint(),
+	}
+	mem.SetCredentials(cfg.AgentID, cfg.AgentToken)
+	return NewWithTransport(cfg, mem), mem
+}
+
+// waitResults espera hasta que haya n resultados reportados
+func waitResults(t *testing.T, mem *commtest.Memory, n int) []models.Result {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if results := mem.Results(); len(results) >= n {
+			return results
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d result(s), got %d", n, len(mem.Results()))
+	return nil
+}
+
+func shellCommand(id, script string) models.Command {
+	if runtime.GOOS == "windows" {
+		return models.Command{ID: id, Type: "powershell", Payload: script, Timeout: 30}
+	}
+	return models.Command{ID: id, Type: "bash", Payload: script, Timeout: 30}
+}
+
+func TestPolledCommandIsExecutedAndReported(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses bash")
+	}
+	a, mem := newTestAgent(t)
+	mem.Enqueue(shellCommand("job-1", `echo hola; echo "log" > "$SE_ARTIFACTS_DIR/run.log"`))
+
+	a.tick(context.Background())
+
+	results := waitResults(t, mem, 1)
+	r := results[0]
+	if r.JobID != "job-1" || r.ExitCode != 0 || r.Stdout != "hola\n" {
+		t.Fatalf("unexpected result: %+v", r)
+	}
+	if len(r.Artifacts) != 1 || r.Artifacts[0] != "run.log" {
+		t.Errorf("artifacts = %v, want [run.log]", r.Artifacts)
+	}
+	if data, ok := mem.Artifact("job-1", "run.log"); !ok || string(data) != "log\n" {
+		t.Errorf("artifact content = %q, %v", data, ok)
+	}
+}
+
+func TestDuplicateCommandRunsOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses bash")
+	}
+	a, mem := newTestAgent(t)
+	cmd := shellCommand("job-1", "sleep 0.2")
+
+	// El mismo job por poll y por push
+	a.dispatch(context.Background(), cmd)
+	a.dispatch(context.Background(), cmd)
+
+	waitResults(t, mem, 1)
+	time.Sleep(300 * time.Millisecond)
+	if n := len(mem.Results()); n != 1 {
+		t.Errorf("got %d results, want 1", n)
+	}
+}
+
+func TestRefusedAgentIgnoresPushedCommands(t *testing.T) {
+	a, mem := newTestAgent(t)
+	a.refused.Store(true)
+
+	a.dispatch(context.Background(), shellCommand("job-1", "echo no"))
+
+	a.mu.Lock()
+	jobs := len(a.jobs)
+	a.mu.Unlock()
+	if jobs != 0 {
+		t.Errorf("refused agent accepted a job")
+	}
+	if n := len(mem.Results()); n != 0 {
+		t.Errorf("refused agent reported %d results", n)
+	}
+}
+
+func TestSingleNotFoundDoesNotReenroll(t *testing.T) {
+	a, mem := newTestAgent(t)
+	notFound := &communicator.StatusError{StatusCode: 404}
+
+	for i := 1; i < notFoundThreshold; i++ {
+		mem.FailNext(notFound)
+		a.tick(context.Background())
+	}
+	if id, _ := mem.Credentials(); id != "agent-1" {
+		t.Fatalf("re-enrolled after %d 404s: agent is now %s", notFoundThreshold-1, id)
+	}
+
+	// Un poll exitoso reinicia la cuenta
+	a.tick(context.Background())
+	mem.FailNext(notFound)
+	a.tick(context.Background())
+	if id, _ := mem.Credentials(); id != "agent-1" {
+		t.Fatalf("404 count was not reset by a successful poll")
+	}
+}
+
+func TestRepeatedNotFoundReenrolls(t *testing.T) {
+	a, mem := newTestAgent(t)
+
+	for i := 0; i < notFoundThreshold; i++ {
+		mem.FailNext(&communicator.StatusError{StatusCode: 404})
+		a.tick(context.Background())
+	}
+	if id, token := mem.Credentials(); id == "agent-1" || token == "token-1" {
+		t.Fatalf("not re-enrolled after %d 404s", notFoundThreshold)
+	}
+}
+
+func TestAgentDeletedReenrollsImmediately(t *testing.T) {
+	a, mem := newTestAgent(t)
+
+	mem.FailNext(&communicator.StatusError{StatusCode: 404, Body: `{"error":"agent_deleted"}`})
+	a.tick(context.Background())
+
+	if id, _ := mem.Credentials(); id == "agent-1" {
+		t.Fatal("not re-enrolled after an explicit agent_deleted")
+	}
+	if a.config.AgentID == "agent-1" {
+		t.Error("config still has the old AgentID")
+	}
+}
+
+func TestUnauthorizedOutsideRunLoopOnlyQueuesReenroll(t *testing.T) {
+	a, mem := newTestAgent(t)
+
+	// Lo que hace un job al recibir un 401 al reportar
+	a.handleError(context.Background(), &communicator.StatusError{StatusCode: 401})
+
+	if a.config.AgentID != "agent-1" {
+		t.Fatal("credentials changed outside the run loop")
+	}
+	select {
+	case reason := <-a.reenrollRequests:
+		a.reenroll(context.Background(), reason)
+	default:
+		t.Fatal("no re-enrollment was requested")
+	}
+	if id, _ := mem.Credentials(); id == "agent-1" {
+		t.Error("run loop did not re-enroll")
+	}
+}
+
+func TestRegistersInRunNotInNew(t *testing.T) {
+	mem := commtest.NewMemory()
+	cfg := &Config{
+		ServerURLs:        []string{"memory"},
+		APIKey:            "api-key",
+		PollInterval:      30,
+		HeartbeatInterval: 60,
+		DataDir:           t.TempDir(),
+	}
+	a := NewWithTransport(cfg, mem)
+	if id, _ := mem.Credentials(); id != "" {
+		t.Fatal("NewWithTransport registered the agent")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if id, _ := mem.Credentials(); id != "" {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Run did not register the agent")
+}
+
+func TestStopWhileWaitingForFileDropRegistration(t *testing.T) {
+	key, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	comm, err := communicator.NewFileDrop(communicator.FileDropOptions{
+		Inbox:     dir,
+		Outbox:    filepath.Join(dir, "outbox"),
+		ServerKey: key,
+		StateDir:  dir,
+	}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{
+		Transport:         TransportFile,
+		APIKey:            "api-key",
+		PollInterval:      30,
+		HeartbeatInterval: 60,
+		DataDir:           dir,
+	}
+
+	// Lo que hace el servicio: New, Start y más tarde Stop
+	a := NewWithTransport(cfg, comm)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run kept waiting for the registration bundle after stop")
+	}
+	if cfg.AgentID != "" {
+		t.Errorf("registered as %q without a response bundle", cfg.AgentID)
+	}
+}
+
+func TestResultReportedAfterStop(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses bash")
+	}
+	a, mem := newTestAgent(t)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	a.dispatch(ctx, shellCommand("job-1", "sleep 0.2; echo listo"))
+	cancel()
+
+	if r := waitResults(t, mem, 1)[0]; r.JobID != "job-1" || r.Stdout != "listo\n" {
+		t.Fatalf("unexpected result: %+v", r)
+	}
+}
+
+func TestWithGraceOutlivesParent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	graceCtx, stop := withGrace(ctx, 100*time.Millisecond)
+	defer stop()
+
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	if graceCtx.Err() != nil {
+		t.Fatal("canceled together with its parent")
+	}
+	select {
+	case <-graceCtx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("not canceled after the grace period")
+	}
+}
+
+func TestArtifactsDeferredOnMeteredLink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses bash")
+	}
+	bandwidth.SetMetered(true)
+	defer bandwidth.SetMetered(false)
+	a, mem := newTestAgent(t)
+
+	a.dispatch(context.Background(), shellCommand("job-1", `echo "log" > "$SE_ARTIFACTS_DIR/run.log"`))
+	r := waitResults(t, mem, 1)[0]
+	if len(r.Artifacts) != 0 || len(r.DeferredArtifacts) != 1 || r.DeferredArtifacts[0] != "run.log" {
+		t.Fatalf("artifacts = %v, deferred = %v, want run.log deferred", r.Artifacts, r.DeferredArtifacts)
+	}
+	if _, ok := mem.Artifact("job-1", "run.log"); ok {
+		t.Fatal("artifact uploaded on a metered link")
+	}
+
+	// Sigue medido: no se sube
+	a.uploadDeferredArtifacts(context.Background())
+	if _, ok := mem.Artifact("job-1", "run.log"); ok {
+		t.Fatal("deferred artifact uploaded while still metered")
+	}
+
+	// Tras un reinicio los apartados se recuperan
+	a = NewWithTransport(a.config, mem)
+	a.recoverArtifacts()
+	if !a.artifactsDeferred.Load() {
+		t.Fatal("deferred artifacts not found after restart")
+	}
+
+	bandwidth.SetMetered(false)
+	a.uploadDeferredArtifacts(context.Background())
+	if data, ok := mem.Artifact("job-1", "run.log"); !ok || string(data) != "log\n" {
+		t.Errorf("artifact content = %q, %v", data, ok)
+	}
+	if a.artifactsDeferred.Load() {
+		t.Error("still flagged after uploading everything")
+	}
+	if entries, _ := os.ReadDir(a.deferredArtifactsDir()); len(entries) != 0 {
+		t.Errorf("%d deferred job(s) left on disk", len(entries))
+	}
+}
+
+func TestFileDropCommandRunsWithoutPolling(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses bash")
+	}
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	inbox, outbox := filepath.Join(dir, "inbox"), filepath.Join(dir, "outbox")
+	if err := os.MkdirAll(inbox, 0700); err != nil {
+		t.Fatal(err)
+	}
+	comm, err := communicator.NewFileDrop(communicator.FileDropOptions{
+		Inbox: inbox, Outbox: outbox, ServerKey: pub, StateDir: dir,
+	}, "token-1", "agent-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Sin DeliveryMode: el poll por intervalo no llegaría en el test
+	cfg := &Config{
+		Transport:         TransportFile,
+		AgentID:           "agent-1",
+		AgentToken:        "token-1",
+		PollInterval:      3600,
+		HeartbeatInterval: 3600,
+		DataDir:           dir,
+		Fingerprint:       system.CollectFingerprint(),
+	}
+	a := NewWithTransport(cfg, comm)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+	// Después del poll inicial de Run
+	time.Sleep(300 * time.Millisecond)
+
+	payload, _ := json.Marshal(map[string]any{
+		"id":         "b1",
+		"agent_id":   "agent-1",
+		"expires_at": time.Now().Add(time.Hour),
+		"commands":   []models.Command{shellCommand("job-1", "echo hola")},
+	})
+	bundle, _ := json.Marshal(communicator.Bundle{
+		Kind:      "commands",
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, payload)),
+	})
+	if err := os.WriteFile(filepath.Join(inbox, "b1.json"), bundle, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if results, _ := filepath.Glob(filepath.Join(outbox, "result-agent-1-*.json")); len(results) > 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("dropped command did not run until the next poll")
+}
+
+func TestReenrollWhileJobsReadAgentID(t *testing.T) {
+	a, mem := newTestAgent(t)
+
+	// Lo que hacen un job que recibe un 403 y el inventario mientras el
+	// loop de Run se registra de nuevo; con -race detecta lecturas sin mu
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			a.handleError(context.Background(), communicator.ErrForbidden)
+		}
+	}()
+	a.reenroll(context.Background(), "test")
+	<-done
+
+	if id, _ := mem.Credentials(); id == "agent-1" || id != a.agentID() {
+		t.Errorf("transport has %q, agent has %q after re-enrolling", id, a.agentID())
+	}
+}
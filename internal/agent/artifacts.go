@@ -0,0 +1,158 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/sentineledge/agent/internal/bandwidth"
+)
+
+// uploadArtifacts sube los archivos que el job dejó en dir y retorna los
+// nombres de los que llegaron al servidor. Un artefacto que falla no
+// impide reportar el resultado.
+func (a *Agent) uploadArtifacts(ctx context.Context, jobID, dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("Could not read artifacts of job %s: %v", jobID, err)
+		return nil
+	}
+
+	var uploaded []string
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if err := a.uploadArtifact(ctx, jobID, filepath.Join(dir, e.Name())); err != nil {
+			log.Printf("Artifact %s of job %s not uploaded: %v", e.Name(), jobID, err)
+			continue
+		}
+		uploaded = append(uploaded, e.Name())
+	}
+	return uploaded
+}
+
+func (a *Agent) uploadArtifact(ctx context.Context, jobID, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return a.comm.UploadArtifact(ctx, jobID, filepath.Base(path), f)
+}
+
+// artifactsDir es donde se crean los directorios de artefactos de los
+// jobs. Está en DataDir y no en el temporal del sistema para que apartar
+// los de un job sea un rename en el mismo disco y sobreviva un reinicio.
+func (a *Agent) artifactsDir() string {
+	return filepath.Join(a.config.DataDir, "artifacts")
+}
+
+// deferredArtifactsDir guarda, por job, los artefactos que esperan un
+// enlace no medido
+func (a *Agent) deferredArtifactsDir() string {
+	return filepath.Join(a.artifactsDir(), "deferred")
+}
+
+// recoverArtifacts borra los directorios de jobs que no terminaron antes
+// de un reinicio y marca los apartados para subirlos
+func (a *Agent) recoverArtifacts() {
+	leftovers, _ := filepath.Glob(filepath.Join(a.artifactsDir(), "job-*"))
+	for _, dir := range leftovers {
+		os.RemoveAll(dir)
+	}
+	if jobs, _ := os.ReadDir(a.deferredArtifactsDir()); len(jobs) > 0 {
+		a.artifactsDeferred.Store(true)
+	}
+}
+
+// handleArtifacts sube los artefactos del job, salvo que el enlace sea
+// medido: en ese caso los aparta para uploadDeferredArtifacts. Retorna los
+// subidos y los apartados.
+func (a *Agent) handleArtifacts(ctx context.Context, jobID, dir string) (uploaded, deferred []string) {
+	if !bandwidth.Metered() {
+		return a.uploadArtifacts(ctx, jobID, dir), nil
+	}
+	names := artifactNames(dir)
+	if len(names) == 0 {
+		return nil, nil
+	}
+	// El job ID es el nombre del directorio apartado
+	if filepath.Base(jobID) != jobID || !filepath.IsLocal(jobID) {
+		return a.uploadArtifacts(ctx, jobID, dir), nil
+	}
+
+	dest := filepath.Join(a.deferredArtifactsDir(), jobID)
+	err := os.MkdirAll(a.deferredArtifactsDir(), 0700)
+	if err == nil {
+		err = os.Rename(dir, dest)
+	}
+	if err != nil {
+		log.Printf("Could not defer artifacts of job %s: %v — uploading now", jobID, err)
+		return a.uploadArtifacts(ctx, jobID, dir), nil
+	}
+	a.artifactsDeferred.Store(true)
+	log.Printf("Link is metered — deferring %d artifact(s) of job %s", len(names), jobID)
+	return nil, names
+}
+
+// uploadDeferredArtifacts sube los artefactos apartados y borra los que
+// llegaron. Los que fallan, o todos si el enlace vuelve a ser medido,
+// quedan para el próximo heartbeat.
+func (a *Agent) uploadDeferredArtifacts(ctx context.Context) {
+	if bandwidth.Metered() || !a.uploadingDeferred.CompareAndSwap(false, true) {
+		return
+	}
+	defer a.uploadingDeferred.Store(false)
+	a.artifactsDeferred.Store(false)
+
+	jobs, err := os.ReadDir(a.deferredArtifactsDir())
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Could not read deferred artifacts: %v", err)
+			a.artifactsDeferred.Store(true)
+		}
+		return
+	}
+	log.Println("Link no longer metered — uploading deferred artifacts")
+
+	for _, job := range jobs {
+		if !job.IsDir() {
+			continue
+		}
+		dir := filepath.Join(a.deferredArtifactsDir(), job.Name())
+		for _, name := range artifactNames(dir) {
+			if bandwidth.Metered() || ctx.Err() != nil {
+				a.artifactsDeferred.Store(true)
+				return
+			}
+			path := filepath.Join(dir, name)
+			if err := a.uploadArtifact(ctx, job.Name(), path); err != nil {
+				log.Printf("Deferred artifact %s of job %s not uploaded: %v", name, job.Name(), err)
+				a.artifactsDeferred.Store(true)
+				continue
+			}
+			os.Remove(path)
+		}
+		if len(artifactNames(dir)) == 0 {
+			os.RemoveAll(dir)
+		}
+	}
+}
+
+// artifactNames son los archivos del primer nivel de dir, los únicos que
+// se suben
+func artifactNames(dir string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	return names
+}
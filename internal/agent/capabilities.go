@@ -0,0 +1,53 @@
+package agent
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/sentineledge/agent/internal/executor"
+	"github.com/sentineledge/agent/internal/identity"
+	"github.com/sentineledge/agent/internal/version"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// capabilities arma el documento que el agente envía al registrarse y en
+// cada heartbeat
+func capabilities(cfg *Config) *models.Capabilities {
+	caps := &models.Capabilities{
+		ProtocolVersion: version.ProtocolVersion,
+		AgentVersion:    version.Version,
+		OS:              runtime.GOOS,
+		Arch:            runtime.GOARCH,
+		CommandTypes:    executor.CommandTypes(),
+		Features:        []string{"progress", "structured_output", "output_transcoding", "clock_skew_correction"},
+	}
+	if cfg.vaultConfigured() {
+		caps.Features = append(caps.Features, "vault")
+	}
+
+	if cfg.Transport == TransportMQTT || cfg.Transport == TransportFile {
+		caps.Transports = []string{cfg.Transport}
+		return caps
+	}
+
+	// Lo que sigue solo aplica al transporte HTTP
+	caps.Transports = []string{DeliveryPoll, DeliveryLongPoll, DeliveryWebSocket}
+	caps.Features = append(caps.Features, "request_signing")
+	if cfg.CompressThreshold > 0 {
+		caps.Features = append(caps.Features, "compression")
+	}
+	if cfg.ResultBatchMillis > 0 {
+		caps.Features = append(caps.Features, "result_batching")
+	}
+	if cfg.TokenRefreshHours > 0 {
+		caps.Features = append(caps.Features, "token_refresh")
+	}
+	if _, err := os.Stat(filepath.Join(cfg.DataDir, identity.KeyFile)); err == nil {
+		caps.Features = append(caps.Features, "mtls")
+	}
+	if len(cfg.ServerURLs) > 1 {
+		caps.Features = append(caps.Features, "failover")
+	}
+	return caps
+}
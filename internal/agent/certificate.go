@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"time"
+
+	"github.com/sentineledge/agent/internal/communicator"
+	"github.com/sentineledge/agent/internal/identity"
+)
+
+const certCheckInterval = 12 * time.Hour
+
+// checkCertificate pide un certificado cliente si el agente no tiene, o uno
+// nuevo con llave nueva cuando queda poco de vigencia
+func (a *Agent) checkCertificate(ctx context.Context) {
+	renewer, ok := a.comm.(communicator.CertificateRenewer)
+	if !ok {
+		return
+	}
+
+	current, err := identity.Load(a.config.DataDir)
+	if err == nil && !current.NeedsRenewal(time.Now()) {
+		return
+	}
+	if err == nil {
+		log.Printf("Client certificate expires %s — renewing", current.NotAfter().Format(time.RFC3339))
+	} else {
+		log.Println("No client certificate — requesting one")
+	}
+
+	pending, err := identity.GenerateCSR(a.config.Hostname)
+	if err != nil {
+		log.Printf("Certificate renewal error: %v", err)
+		return
+	}
+
+	certPEM, err := renewer.RenewCertificate(ctx, pending.CSR)
+	if err != nil {
+		log.Printf("Certificate renewal error: %v", err)
+		return
+	}
+
+	if id := saveIdentity(a.config, pending, certPEM); id != nil {
+		renewer.SetCertificate(id.Certificate())
+	}
+}
+
+// loadCertificate carga el certificado de DataDir en el transporte, si este
+// usa certificados y ya hay uno
+func loadCertificate(cfg *Config, t communicator.Transport) {
+	renewer, ok := t.(communicator.CertificateRenewer)
+	if !ok {
+		return
+	}
+	id, err := identity.Load(cfg.DataDir)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Warning: could not load client certificate: %v", err)
+		}
+		return
+	}
+	log.Printf("Client certificate loaded, expires %s", id.NotAfter().Format(time.RFC3339))
+	renewer.SetCertificate(id.Certificate())
+}
+
+// saveIdentity guarda llave y certificado en DataDir. Retorna nil si falla.
+func saveIdentity(cfg *Config, pending *identity.Pending, certPEM string) *identity.Identity {
+	id, err := pending.Complete(certPEM)
+	if err != nil {
+		log.Printf("Invalid client certificate from server: %v", err)
+		return nil
+	}
+	if err := id.Save(cfg.DataDir); err != nil {
+		log.Printf("Could not save client certificate: %v", err)
+		return nil
+	}
+	log.Printf("Client certificate saved, expires %s", id.NotAfter().Format(time.RFC3339))
+	return id
+}
@@ -0,0 +1,30 @@
+package agent
+
+import (
+	"log"
+	"time"
+
+	"github.com/sentineledge/agent/internal/clock"
+)
+
+// checkClockSkew compara el desfase estimado del reloj con el umbral de
+// ClockSkewAlertSeconds y avisa al cruzarlo en cualquier sentido.
+// Retorna el desfase, si hay estimación y si está por encima del umbral.
+func (a *Agent) checkClockSkew() (skew time.Duration, known, alert bool) {
+	skew, known = clock.Skew()
+	threshold := time.Duration(a.config.ClockSkewAlertSeconds) * time.Second
+	if !known || threshold <= 0 {
+		return skew, known, false
+	}
+
+	alert = skew.Abs() > threshold
+	if alert != a.skewAlert.Swap(alert) {
+		if alert {
+			log.Printf("WARNING: local clock is off by %s from the server (threshold %s) — reported times are being corrected; check NTP on this machine",
+				skew.Round(time.Second), threshold)
+		} else {
+			log.Printf("Local clock back within %s of the server (off by %s)", threshold, skew.Round(time.Second))
+		}
+	}
+	return skew, known, alert
+}
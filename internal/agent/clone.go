@@ -0,0 +1,76 @@
+package agent
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sentineledge/agent/internal/communicator"
+	"github.com/sentineledge/agent/internal/identity"
+	"github.com/sentineledge/agent/internal/system"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// checkClone compara el fingerprint guardado junto a la identidad con el de
+// esta máquina. Si no coinciden, el agent.yaml vino de otra máquina (una
+// plantilla de VM clonada, un disco copiado): se descarta la identidad
+// heredada y se retorna el AgentID original para reportarlo al registrarse.
+func checkClone(cfg *Config, t communicator.Transport) (clonedFrom string) {
+	if cfg.AgentID == "" {
+		return ""
+	}
+
+	current := system.CollectFingerprint()
+	if cfg.Fingerprint == nil {
+		// Registrado con una versión sin fingerprint: se adopta el actual
+		cfg.Fingerprint = current
+		if err := saveConfig(cfg); err != nil {
+			log.Printf("Warning: could not save machine fingerprint: %v", err)
+		}
+		return ""
+	}
+	if sameMachine(cfg.Fingerprint, current) {
+		return ""
+	}
+
+	log.Printf("WARNING: machine fingerprint does not match agent %s — this looks like a cloned machine. "+
+		"Discarding the inherited identity and registering as a new agent.", cfg.AgentID)
+
+	clonedFrom = cfg.AgentID
+	cfg.AgentID = ""
+	cfg.AgentToken = ""
+	cfg.SigningSecret = ""
+	cfg.Fingerprint = nil
+	setCredentials(cfg, t)
+
+	// El certificado cliente también es de la máquina original
+	if renewer, ok := t.(communicator.CertificateRenewer); ok {
+		renewer.SetCertificate(nil)
+	}
+	for _, name := range []string{identity.KeyFile, identity.CertFile} {
+		if err := os.Remove(filepath.Join(cfg.DataDir, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Warning: could not remove inherited %s: %v", name, err)
+		}
+	}
+	return clonedFrom
+}
+
+// sameMachine compara el identificador fuerte más confiable que tengan
+// ambos fingerprints: el UUID de DMI, que cambia al clonar una VM, o si no
+// el machine-id, que cambia si la plantilla se preparó bien. El serial y
+// la MAC no alcanzan para decidir un clon: la MAC cambia al reemplazar una
+// placa de red y muchos equipos no tienen serial. Sin un identificador
+// fuerte en ambos no se re-registra.
+func sameMachine(saved, current *models.Fingerprint) bool {
+	pairs := [][2]string{
+		{strings.ToLower(saved.DMIUUID), strings.ToLower(current.DMIUUID)},
+		{saved.MachineID, current.MachineID},
+	}
+	for _, p := range pairs {
+		if p[0] != "" && p[1] != "" {
+			return p[0] == p[1]
+		}
+	}
+	return true
+}
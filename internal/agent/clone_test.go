@@ -0,0 +1,97 @@
+package agent
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sentineledge/agent/internal/communicator/commtest"
+	"github.com/sentineledge/agent/internal/identity"
+	"github.com/sentineledge/agent/internal/system"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+func TestSameMachine(t *testing.T) {
+	tests := []struct {
+		name           string
+		saved, current models.Fingerprint
+		want           bool
+	}{
+		{"same DMI UUID", models.Fingerprint{DMIUUID: "ABC", MACHash: "m1"}, models.Fingerprint{DMIUUID: "abc", MACHash: "m2"}, true},
+		{"cloned VM", models.Fingerprint{DMIUUID: "abc", MachineID: "x"}, models.Fingerprint{DMIUUID: "def", MachineID: "x"}, false},
+		{"DMI UUID decides over machine-id", models.Fingerprint{DMIUUID: "abc", MachineID: "x"}, models.Fingerprint{DMIUUID: "abc", MachineID: "y"}, true},
+		{"machine-id without DMI", models.Fingerprint{MachineID: "x"}, models.Fingerprint{MachineID: "y"}, false},
+		{"DMI only on one side", models.Fingerprint{DMIUUID: "abc", MachineID: "x"}, models.Fingerprint{MachineID: "x"}, true},
+		{"no strong ID now", models.Fingerprint{DMIUUID: "abc", MachineID: "x"}, models.Fingerprint{Serial: "s", MACHash: "m"}, true},
+		{"only MAC differs", models.Fingerprint{Serial: "s", MACHash: "m1"}, models.Fingerprint{Serial: "s", MACHash: "m2"}, true},
+		{"only serial differs", models.Fingerprint{Serial: "s1"}, models.Fingerprint{Serial: "s2"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sameMachine(&tt.saved, &tt.current); got != tt.want {
+				t.Errorf("sameMachine = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCloneCheckedInRunNotInNew(t *testing.T) {
+	current := system.CollectFingerprint()
+	if current.DMIUUID == "" && current.MachineID == "" {
+		t.Skip("no strong machine ID on this host")
+	}
+	original := *current
+	original.DMIUUID += "-original"
+	original.MachineID += "-original"
+
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, identity.KeyFile)
+	if err := os.WriteFile(keyFile, []byte("inherited"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mem := commtest.NewMemory()
+	mem.SetCredentials("agent-1", "token-1")
+	cfg := &Config{
+		ServerURLs:        []string{"memory"},
+		AgentID:           "agent-1",
+		AgentToken:        "token-1",
+		PollInterval:      30,
+		HeartbeatInterval: 60,
+		DataDir:           dir,
+		Fingerprint:       &original,
+	}
+
+	// Lo que hace main para install, start, stop o uninstall
+	a := NewWithTransport(cfg, mem)
+	if cfg.AgentID != "agent-1" {
+		t.Fatal("NewWithTransport discarded the identity")
+	}
+	if _, err := os.Stat(keyFile); err != nil {
+		t.Fatalf("NewWithTransport removed %s: %v", identity.KeyFile, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if id, _ := mem.Credentials(); id != "agent-1" {
+			if _, err := os.Stat(keyFile); !os.IsNotExist(err) {
+				t.Errorf("inherited %s kept after re-registering", identity.KeyFile)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Run did not re-register the cloned machine")
+}
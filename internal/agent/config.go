@@ -4,22 +4,75 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/sentineledge/agent/internal/bandwidth"
+	"github.com/sentineledge/agent/internal/communicator"
+	"github.com/sentineledge/agent/internal/network"
 	"github.com/sentineledge/agent/internal/vault"
+	"github.com/sentineledge/agent/pkg/models"
 	"github.com/spf13/viper"
 )
 
+const (
+	TokenFromVault = "vault"
+	TokenFromFile  = "file"
+)
+
 type Config struct {
 	ServerURL         string
+	ServerURLs        []string // endpoints en orden de preferencia; el primero es el primario
 	AgentToken        string
+	SigningSecret     string // emitido al registrar; se guarda junto al token
+	TokenSource       string // TokenFromVault o TokenFromFile: dónde guardar el token rotado
 	AgentID           string
 	Hostname          string
+	Transport         string // TransportHTTP, TransportMQTT o TransportFile
 	PollInterval      int
+	HeartbeatInterval int
+	DeliveryMode      string // "poll" (por defecto), "websocket" o "longpoll"; solo HTTP
 	TenantID          string
+	EnrollmentTags    []string            // metadatos que se envían al registrarse
+	Fingerprint       *models.Fingerprint // de la máquina donde se registró; detecta clones
+	Site              string
+	Group             string
 	APIKey            string
 	VaultURL          string
 	VaultClientID     string
 	VaultClientSecret string
+	OutputCodePage    string   // code page legacy de la salida de comandos, ej. "850"
+	DataDir           string   // donde se guardan agent.key y agent.crt
+	CABundle          string   // PEM con CAs adicionales para API, vault y updater
+	CertPins          []string // pins SPKI "sha256/<base64>" del servidor del agente
+	VaultPins         []string // pins de Vaultwarden; vacío: solo las CAs
+	UpdaterPins       []string // pins de las descargas del updater; vacío: solo las CAs
+	TokenRefreshHours int      // cada cuánto rotar el token; 0 lo desactiva
+	CompressThreshold int      // bytes desde los cuales se comprimen los bodies; 0 lo desactiva
+	ResultBatchMillis int      // ventana para juntar resultados en un batch; 0 (por defecto) lo desactiva
+	ProxyURL          string   // proxy HTTP explícito; vacío usa HTTPS_PROXY
+	ProxyUsername     string
+	ProxyPassword     string
+	NoProxy           []string
+	MQTTBroker        string // tcp://, ssl:// o ws(s):// del broker con Transport "mqtt"
+	MQTTUsername      string // vacío: AgentID y token
+	MQTTPassword      string
+	MQTTTopicPrefix   string
+	FileDropInbox     string // bundles firmados del servidor, ej. un USB montado
+	FileDropOutbox    string // bundles del agente para llevar al servidor
+	FileDropServerKey string // llave pública ed25519 del servidor en base64
+	// RequireSignedResponses rechaza comandos de respuestas sin firma HMAC
+	// desde el arranque; sin esto se rechazan después de la primera firmada
+	RequireSignedResponses bool
+	// Timeouts es el plazo por tipo de petición, de la sección Timeouts
+	// de agent.yaml en segundos
+	Timeouts communicator.Timeouts
+	// ClockSkewAlertSeconds es el desfase del reloj contra el servidor
+	// desde el cual se avisa; 0 lo desactiva
+	ClockSkewAlertSeconds int
+	// Bandwidth son los límites de subida y bajada, su horario y si el
+	// enlace es medido
+	Bandwidth bandwidth.Options
 }
 
 func LoadConfig() *Config {
@@ -35,7 +88,15 @@ func LoadConfig() *Config {
 	viper.SetEnvPrefix("SE")
 	viper.AutomaticEnv()
 
+	viper.SetDefault("Transport", TransportHTTP)
 	viper.SetDefault("PollInterval", 30)
+	viper.SetDefault("HeartbeatInterval", 60)
+	viper.SetDefault("DeliveryMode", DeliveryPoll)
+	viper.SetDefault("TokenRefreshHours", 24)
+	viper.SetDefault("CompressThreshold", communicator.DefaultCompressThreshold)
+	viper.SetDefault("ResultBatchMillis", communicator.DefaultBatchWindow.Milliseconds())
+	viper.SetDefault("ClockSkewAlertSeconds", 120)
+	viper.SetDefault("MQTTTopicPrefix", communicator.DefaultMQTTTopicPrefix)
 	viper.SetDefault("ServerURL", "https://saapi.ardepa.site")
 
 	if err := viper.ReadInConfig(); err != nil {
@@ -44,17 +105,79 @@ func LoadConfig() *Config {
 
 	cfg := &Config{
 		ServerURL:         viper.GetString("ServerURL"),
+		ServerURLs:        viper.GetStringSlice("ServerURLs"),
 		AgentID:           viper.GetString("AgentID"),
+		Transport:         viper.GetString("Transport"),
 		PollInterval:      viper.GetInt("PollInterval"),
+		HeartbeatInterval: viper.GetInt("HeartbeatInterval"),
+		DeliveryMode:      viper.GetString("DeliveryMode"),
 		TenantID:          viper.GetString("TenantID"),
+		EnrollmentTags:    viper.GetStringSlice("EnrollmentTags"),
+		Site:              viper.GetString("Site"),
+		Group:             viper.GetString("Group"),
 		APIKey:            viper.GetString("APIKey"),
 		VaultURL:          viper.GetString("VaultURL"),
 		VaultClientID:     viper.GetString("VaultClientID"),
 		VaultClientSecret: viper.GetString("VaultClientSecret"),
+		OutputCodePage:    viper.GetString("OutputCodePage"),
+		CABundle:          viper.GetString("CABundle"),
+		CertPins:          viper.GetStringSlice("CertPins"),
+		VaultPins:         viper.GetStringSlice("VaultPins"),
+		UpdaterPins:       viper.GetStringSlice("UpdaterPins"),
+		TokenRefreshHours: viper.GetInt("TokenRefreshHours"),
+		CompressThreshold: viper.GetInt("CompressThreshold"),
+		ResultBatchMillis: viper.GetInt("ResultBatchMillis"),
+		ProxyURL:          viper.GetString("ProxyURL"),
+		ProxyUsername:     viper.GetString("ProxyUsername"),
+		ProxyPassword:     viper.GetString("ProxyPassword"),
+		NoProxy:           viper.GetStringSlice("NoProxy"),
+		MQTTBroker:        viper.GetString("MQTTBroker"),
+		MQTTUsername:      viper.GetString("MQTTUsername"),
+		MQTTPassword:      viper.GetString("MQTTPassword"),
+		MQTTTopicPrefix:   viper.GetString("MQTTTopicPrefix"),
+		FileDropInbox:     viper.GetString("FileDropInbox"),
+		FileDropOutbox:    viper.GetString("FileDropOutbox"),
+		FileDropServerKey: viper.GetString("FileDropServerKey"),
+
+		RequireSignedResponses: viper.GetBool("RequireSignedResponses"),
+		ClockSkewAlertSeconds:  viper.GetInt("ClockSkewAlertSeconds"),
+		Timeouts:               loadTimeouts(),
+	}
+
+	// Antes de cualquier conexión, incluida la de Vaultwarden
+	if err := network.Configure(network.Options{
+		CABundle:    cfg.CABundle,
+		Pins:        cfg.CertPins,
+		VaultPins:   cfg.VaultPins,
+		UpdaterPins: cfg.UpdaterPins,
+		Proxy: network.ProxyOptions{
+			URL:      cfg.ProxyURL,
+			Username: cfg.ProxyUsername,
+			Password: cfg.ProxyPassword,
+			NoProxy:  cfg.NoProxy,
+		},
+	}); err != nil {
+		log.Fatalf("Invalid network configuration: %v", err)
+	}
+
+	if err := viper.UnmarshalKey("Bandwidth", &cfg.Bandwidth); err != nil {
+		log.Fatalf("Invalid bandwidth configuration: %v", err)
+	}
+	if err := bandwidth.Configure(cfg.Bandwidth); err != nil {
+		log.Fatalf("Invalid bandwidth configuration: %v", err)
 	}
 
+	if viper.IsSet("Fingerprint") {
+		var fp models.Fingerprint
+		if err := viper.UnmarshalKey("Fingerprint", &fp); err == nil && fp.ID != "" {
+			cfg.Fingerprint = &fp
+		}
+	}
+
+	cfg.TokenSource = TokenFromFile
+
 	// Si hay Vault configurado, obtener el token desde Vaultwarden
-	if cfg.VaultURL != "" && cfg.VaultClientID != "" && cfg.VaultClientSecret != "" {
+	if cfg.vaultConfigured() {
 		log.Println("Vault configured — loading token from Vaultwarden...")
 		vc := vault.NewClient(cfg.VaultURL, cfg.VaultClientID, cfg.VaultClientSecret)
 
@@ -65,9 +188,13 @@ func LoadConfig() *Config {
 				log.Printf("Warning: could not load token from vault: %v", err)
 				log.Println("Falling back to agent.yaml token")
 				cfg.AgentToken = viper.GetString("AgentToken")
+				cfg.SigningSecret = viper.GetString("SigningSecret")
 			} else {
 				log.Println("Token loaded from Vaultwarden successfully")
 				cfg.AgentToken = token
+				cfg.TokenSource = TokenFromVault
+				// Los agentes registrados antes del secreto de firma no lo tienen
+				cfg.SigningSecret, _ = vc.GetSecret("AGENT_SIGNING_" + cfg.AgentID)
 			}
 		} else {
 			// Sin AgentID aún — necesita registrarse, cargar APIKey desde vault
@@ -83,11 +210,68 @@ func LoadConfig() *Config {
 	} else {
 		// Sin Vault — usar valores del agent.yaml directamente
 		cfg.AgentToken = viper.GetString("AgentToken")
+		cfg.SigningSecret = viper.GetString("SigningSecret")
 		log.Println("No Vault configured — using agent.yaml credentials")
 	}
 
+	var urls []string
+	for _, u := range cfg.ServerURLs {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 && strings.TrimSpace(cfg.ServerURL) != "" {
+		urls = []string{strings.TrimSpace(cfg.ServerURL)}
+	}
+	if len(urls) == 0 && (cfg.Transport == TransportHTTP || cfg.Transport == "") {
+		log.Fatalf("Invalid configuration: ServerURL or ServerURLs must contain at least one URL")
+	}
+	cfg.ServerURLs = urls
+	if len(urls) > 0 {
+		cfg.ServerURL = urls[0]
+	}
+
+	// Los archivos del agente van junto a agent.yaml, o junto al exe
+	cfg.DataDir = "."
+	if used := viper.ConfigFileUsed(); used != "" {
+		cfg.DataDir = filepath.Dir(used)
+	} else if exePath != "" {
+		cfg.DataDir = filepath.Dir(exePath)
+	}
+
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = 60
+	}
+
 	if hostname, err := os.Hostname(); err == nil {
 		cfg.Hostname = hostname
 	}
 	return cfg
 }
+
+// loadTimeouts lee la sección Timeouts, ej. "Timeouts: {Poll: 30}"; lo
+// que falte queda con el valor por defecto
+func loadTimeouts() communicator.Timeouts {
+	t := communicator.DefaultTimeouts
+	fields := map[string]*time.Duration{
+		"Register":    &t.Register,
+		"Poll":        &t.Poll,
+		"Result":      &t.Result,
+		"Progress":    &t.Progress,
+		"Heartbeat":   &t.Heartbeat,
+		"Inventory":   &t.Inventory,
+		"Artifact":    &t.Artifact,
+		"Certificate": &t.Certificate,
+		"Token":       &t.Token,
+	}
+	for name, d := range fields {
+		if key := "Timeouts." + name; viper.IsSet(key) {
+			*d = time.Duration(viper.GetInt(key)) * time.Second
+		}
+	}
+	return t
+}
+
+func (cfg *Config) vaultConfigured() bool {
+	return cfg.VaultURL != "" && cfg.VaultClientID != "" && cfg.VaultClientSecret != ""
+}
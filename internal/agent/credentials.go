@@ -0,0 +1,232 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sentineledge/agent/internal/communicator"
+	"github.com/sentineledge/agent/internal/identity"
+	"github.com/sentineledge/agent/internal/system"
+	"github.com/sentineledge/agent/internal/vault"
+	"github.com/spf13/viper"
+)
+
+// Tras un 401 no se intenta registrar de nuevo más de una vez en este lapso
+const reenrollInterval = 15 * time.Minute
+
+// configMu serializa las escrituras de agent.yaml
+var configMu sync.Mutex
+
+// register registra el agente, guarda el certificado cliente si el
+// servidor lo emitió y persiste ID, token y fingerprint. clonedFrom es el
+// AgentID heredado si la máquina resultó ser un clon. Solo lo llama Run.
+func (a *Agent) register(ctx context.Context, clonedFrom string) error {
+	cfg, t := a.config, a.comm
+	pending, err := identity.GenerateCSR(cfg.Hostname)
+	if err != nil {
+		return err
+	}
+
+	fingerprint := system.CollectFingerprint()
+	resp, err := t.Register(ctx, communicator.RegisterRequest{
+		TenantID:     cfg.TenantID,
+		APIKey:       cfg.APIKey,
+		CSR:          pending.CSR,
+		Capabilities: capabilities(cfg),
+		Fingerprint:  fingerprint,
+		ClonedFrom:   clonedFrom,
+		Tags:         cfg.EnrollmentTags,
+		Site:         cfg.Site,
+		Group:        cfg.Group,
+	})
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	cfg.AgentID = resp.ID
+	cfg.AgentToken = resp.Token
+	cfg.SigningSecret = resp.SigningSecret
+	cfg.Fingerprint = fingerprint
+	a.mu.Unlock()
+
+	if resp.Certificate != "" {
+		saveIdentity(cfg, pending, resp.Certificate)
+	}
+
+	// Con Vault configurado el token va a Vaultwarden, nunca a agent.yaml
+	cfg.TokenSource = TokenFromFile
+	if cfg.vaultConfigured() {
+		cfg.TokenSource = TokenFromVault
+	}
+	return persistToken(cfg)
+}
+
+// agentID retorna el ID actual para las goroutines que no son el loop de
+// Run: jobs, inventario y long-poll. Run lo cambia al registrarse de nuevo,
+// siempre bajo mu.
+func (a *Agent) agentID() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.config.AgentID
+}
+
+// enroll registra un agente sin credenciales. Retorna false si se canceló
+// ctx mientras esperaba la respuesta.
+func (a *Agent) enroll(ctx context.Context) bool {
+	log.Println("No token/ID — registering agent...")
+	if err := a.register(ctx, a.clonedFrom); err != nil {
+		if ctx.Err() != nil {
+			return false
+		}
+		log.Fatalf("Agent cannot be registered: %v", err)
+	}
+	a.clonedFrom = ""
+	setCredentials(a.config, a.comm)
+	loadCertificate(a.config, a.comm)
+	return true
+}
+
+// persistToken guarda el token y el secreto de firma donde se cargó el
+// token. Si Vaultwarden falla se guardan en agent.yaml para no perderlos.
+func persistToken(cfg *Config) error {
+	if cfg.TokenSource == TokenFromVault {
+		vc := vault.NewClient(cfg.VaultURL, cfg.VaultClientID, cfg.VaultClientSecret)
+		err := vc.UpdateSecret("AGENT_TOKEN_"+cfg.AgentID, cfg.AgentToken, OrgID, ColAgentsID)
+		if err == nil && cfg.SigningSecret != "" {
+			err = vc.UpdateSecret("AGENT_SIGNING_"+cfg.AgentID, cfg.SigningSecret, OrgID, ColAgentsID)
+		}
+		if err != nil {
+			log.Printf("Warning: could not store token in vault: %v — saving to agent.yaml", err)
+			cfg.TokenSource = TokenFromFile
+		} else {
+			log.Println("Token stored in Vaultwarden successfully")
+		}
+	}
+	return saveConfig(cfg)
+}
+
+// saveConfig escribe agent.yaml en un archivo temporal y lo renombra, así
+// un corte a mitad de escritura no deja el archivo truncado
+func saveConfig(cfg *Config) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	viper.Set("AgentID", cfg.AgentID)
+	viper.Set("PollInterval", cfg.PollInterval)
+	viper.Set("ServerURL", cfg.ServerURL)
+	viper.Set("TenantID", cfg.TenantID)
+	viper.Set("VaultURL", cfg.VaultURL)
+	viper.Set("VaultClientID", cfg.VaultClientID)
+	viper.Set("VaultClientSecret", cfg.VaultClientSecret)
+	if cfg.Fingerprint != nil {
+		viper.Set("Fingerprint", cfg.Fingerprint)
+	}
+	if cfg.TokenSource == TokenFromFile {
+		viper.Set("AgentToken", cfg.AgentToken)
+		viper.Set("SigningSecret", cfg.SigningSecret)
+	} else {
+		viper.Set("AgentToken", "")
+		viper.Set("SigningSecret", "")
+	}
+
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		path = filepath.Join(cfg.DataDir, "agent.yaml")
+	}
+	ext := filepath.Ext(path)
+	tmp := strings.TrimSuffix(path, ext) + ".tmp" + ext
+
+	if err := viper.WriteConfigAs(tmp); err != nil {
+		return fmt.Errorf("could not write config: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("could not replace config: %w", err)
+	}
+	return nil
+}
+
+// rotateToken pide un token nuevo, lo guarda y recién entonces lo usa
+func (a *Agent) rotateToken(ctx context.Context) {
+	refresher, ok := a.comm.(communicator.TokenRefresher)
+	if !ok {
+		return
+	}
+	resp, err := refresher.RefreshToken(ctx)
+	if err != nil {
+		log.Printf("Token refresh error: %v", err)
+		a.handleError(ctx, err)
+		return
+	}
+
+	a.mu.Lock()
+	a.config.AgentToken = resp.Token
+	a.mu.Unlock()
+	if err := persistToken(a.config); err != nil {
+		log.Printf("Warning: rotated token could not be saved: %v", err)
+	}
+	a.comm.SetCredentials(a.config.AgentID, resp.Token)
+	log.Println("Agent token rotated")
+}
+
+// requestReenroll pide al loop de Run que registre el agente de nuevo. Se
+// usa desde los jobs y el long-poll, que no deben escribir las credenciales
+// mientras Run las lee.
+func (a *Agent) requestReenroll(reason string) {
+	select {
+	case a.reenrollRequests <- reason:
+	default:
+		// Ya hay un pedido pendiente
+	}
+}
+
+// reenroll registra el agente de nuevo con la APIKey cuando el servidor ya
+// no acepta su identidad: token revocado o expirado (401) o agente borrado
+// (404 en el poll). Como máximo una vez cada reenrollInterval para no entrar
+// en un bucle contra el servidor.
+func (a *Agent) reenroll(ctx context.Context, reason string) {
+	a.mu.Lock()
+	if time.Since(a.lastEnrollAt) < reenrollInterval {
+		a.mu.Unlock()
+		return
+	}
+	a.lastEnrollAt = time.Now()
+	a.mu.Unlock()
+
+	log.Printf("%s — re-enrolling", reason)
+
+	if a.config.APIKey == "" && a.config.vaultConfigured() {
+		vc := vault.NewClient(a.config.VaultURL, a.config.VaultClientID, a.config.VaultClientSecret)
+		if apiKey, err := vc.GetSecret("AGENT_APIKEY"); err == nil {
+			a.config.APIKey = apiKey
+		}
+	}
+	if a.config.APIKey == "" {
+		log.Printf("Cannot re-enroll: no APIKey in agent.yaml or vault — retrying in %s", reenrollInterval)
+		return
+	}
+
+	previousID := a.config.AgentID
+	if err := a.register(ctx, ""); err != nil {
+		log.Printf("Re-enrollment failed: %v — retrying in %s", err, reenrollInterval)
+		return
+	}
+	setCredentials(a.config, a.comm)
+	loadCertificate(a.config, a.comm)
+	log.Printf("Agent re-enrolled: %s -> %s", previousID, a.config.AgentID)
+}
+
+// setCredentials pasa al transporte ID, token y secreto de firma actuales
+func setCredentials(cfg *Config, t communicator.Transport) {
+	t.SetCredentials(cfg.AgentID, cfg.AgentToken)
+	if signer, ok := t.(communicator.RequestSigner); ok {
+		signer.SetSigningSecret(cfg.SigningSecret)
+	}
+}
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sentineledge/agent/internal/network"
+)
+
+const diagnoseTimeout = 15 * time.Second
+
+// Diagnose revisa la conectividad con la configuración actual e imprime el
+// resultado de cada chequeo. Retorna false si alguno falló.
+func Diagnose(cfg *Config) bool {
+	ok := true
+	check := func(name string, fn func() (string, error)) {
+		detail, err := fn()
+		if err != nil {
+			ok = false
+			fmt.Printf("[FAIL] %s: %v\n", name, err)
+			return
+		}
+		fmt.Printf("[ OK ] %s: %s\n", name, detail)
+	}
+
+	if p := network.ProxyURL(); p != nil {
+		check("Proxy reachable", func() (string, error) {
+			return dialProxy(p.Host, p.Scheme)
+		})
+	} else {
+		fmt.Println("[ -- ] Proxy: none configured (using environment)")
+	}
+
+	for _, endpoint := range cfg.ServerURLs {
+		check("API server "+endpoint, func() (string, error) {
+			return probe(endpoint, network.PinnedTransport())
+		})
+	}
+
+	if cfg.VaultURL != "" {
+		check("Vault", func() (string, error) {
+			return probe(strings.TrimRight(cfg.VaultURL, "/")+"/alive", network.TargetTransport(network.Vault))
+		})
+	}
+
+	return ok
+}
+
+func dialProxy(host, scheme string) (string, error) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if scheme == "https" {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", host, diagnoseTimeout)
+	if err != nil {
+		return "", err
+	}
+	conn.Close()
+	return host, nil
+}
+
+// probe hace un GET a url a través de transport. Cualquier respuesta HTTP
+// cuenta como alcanzable, salvo que el proxy rechace la autenticación.
+func probe(url string, transport http.RoundTripper) (string, error) {
+	client := &http.Client{
+		Timeout:   diagnoseTimeout,
+		Transport: transport,
+	}
+	start := time.Now()
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return "", fmt.Errorf("proxy authentication failed (407)")
+	}
+	return fmt.Sprintf("HTTP %d in %s", resp.StatusCode, time.Since(start).Round(time.Millisecond)), nil
+}
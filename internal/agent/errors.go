@@ -0,0 +1,123 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/sentineledge/agent/internal/communicator"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+const (
+	// Reintentos al reportar un resultado ante fallos transitorios
+	reportAttempts = 4
+	reportBackoff  = 15 * time.Second
+	// reportGrace es cuánto más puede seguir reportando un resultado ya
+	// terminado cuando se detiene el agente; menos que el stopTimeout del
+	// servicio
+	reportGrace = 5 * time.Second
+)
+
+// handleError reacciona a un error del servidor según su tipo y retorna
+// cuánto esperar antes del próximo intento, o 0 para el backoff normal
+func (a *Agent) handleError(ctx context.Context, err error) time.Duration {
+	if ctx.Err() != nil {
+		// El agente se está deteniendo; el error es la cancelación
+		return 0
+	}
+
+	var protoErr *communicator.ProtocolError
+	var retryErr *communicator.RetryAfterError
+
+	switch {
+	case errors.As(err, &protoErr):
+		if !a.refused.Swap(true) {
+			log.Printf("ERROR: %v. Command polling stopped.", protoErr)
+		}
+	case errors.Is(err, communicator.ErrUnauthorized):
+		a.requestReenroll("Server rejected agent token")
+	case errors.Is(err, communicator.ErrForbidden):
+		// El token es válido pero el agente está deshabilitado o en
+		// cuarentena; insistir no sirve de nada
+		log.Printf("Server denied access to agent %s — it may be disabled; backing off", a.agentID())
+		return maxPollBackoff
+	case errors.As(err, &retryErr):
+		return retryErr.RetryAfter
+	case errors.Is(err, communicator.ErrNetwork):
+		log.Printf("No server endpoint reachable (%s)", a.comm.ActiveEndpoint())
+	}
+	// ErrServer, ErrDecode y firmas inválidas: backoff normal
+	return 0
+}
+
+// withGrace retorna un contexto que se cancela grace después que ctx, para
+// terminar de entregar lo que ya está hecho cuando se detiene el agente
+func withGrace(ctx context.Context, grace time.Duration) (context.Context, context.CancelFunc) {
+	graceCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	stop := context.AfterFunc(ctx, func() {
+		time.AfterFunc(grace, cancel)
+	})
+	return graceCtx, func() {
+		stop()
+		cancel()
+	}
+}
+
+// waitReports espera, como máximo reportGrace, a que terminen los
+// resultados que se están reportando
+func (a *Agent) waitReports() {
+	deadline := time.Now().Add(reportGrace)
+	for a.outbox.Load() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// reportResult envía el resultado de un job. Los fallos transitorios (red,
+// 5xx, rate limit) y un 401 se reintentan; si el servidor rechaza el
+// resultado con otro 4xx, ej. porque ya no conoce el job, se descarta.
+func (a *Agent) reportResult(ctx context.Context, result models.Result) {
+	wait := reportBackoff
+	for attempt := 1; ; attempt++ {
+		err := a.comm.ReportResult(ctx, result)
+		if err == nil {
+			return
+		}
+		if ctx.Err() != nil {
+			log.Printf("Agent stopping — result of job %s not reported", result.JobID)
+			return
+		}
+		log.Printf("Error reporting job %s: %v", result.JobID, err)
+
+		var statusErr *communicator.StatusError
+		var protoErr *communicator.ProtocolError
+		switch {
+		case errors.As(err, &protoErr):
+			a.handleError(ctx, err)
+			return
+		case errors.Is(err, communicator.ErrDecode):
+			// El servidor recibió el resultado; lo que falló es su respuesta
+			return
+		case errors.As(err, &statusErr) && statusErr.StatusCode < 500 &&
+			!errors.Is(err, communicator.ErrUnauthorized) && !errors.Is(err, communicator.ErrRateLimited):
+			log.Printf("Discarding result of job %s", result.JobID)
+			return
+		}
+
+		if attempt == reportAttempts {
+			log.Printf("Giving up reporting job %s after %d attempts", result.JobID, attempt)
+			return
+		}
+		if d := a.handleError(ctx, err); d > 0 {
+			wait = d
+		}
+		select {
+		case <-ctx.Done():
+			log.Printf("Agent stopping — result of job %s not reported", result.JobID)
+			return
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/sentineledge/agent/internal/bandwidth"
+	"github.com/sentineledge/agent/internal/clock"
+	"github.com/sentineledge/agent/internal/system"
+	"github.com/sentineledge/agent/internal/version"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// heartbeat envía el estado del agente y aplica las directivas que
+// retorne el servidor
+func (a *Agent) heartbeat(ctx context.Context) {
+	directives, err := a.comm.Heartbeat(ctx, a.status())
+	if err != nil {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Heartbeat error: %v", err)
+		a.handleError(ctx, err)
+		return
+	}
+
+	if directives.PollInterval > 0 && directives.PollInterval != a.config.PollInterval {
+		log.Printf("Server changed poll interval: %ds -> %ds", a.config.PollInterval, directives.PollInterval)
+		a.config.PollInterval = directives.PollInterval
+		a.schedule.setBase(time.Duration(directives.PollInterval) * time.Second)
+	}
+
+	if directives.Metered != nil && *directives.Metered != bandwidth.Metered() {
+		log.Printf("Server set metered link: %t", *directives.Metered)
+		bandwidth.SetMetered(*directives.Metered)
+	}
+
+	switch {
+	case directives.CollectInventory:
+		log.Println("Server requested inventory")
+		go a.collectAndSendInventory(ctx)
+	case a.inventoryDeferred.Load() && !bandwidth.Metered():
+		log.Println("Link no longer metered — sending deferred inventory")
+		go a.collectAndSendInventory(ctx)
+	}
+	if a.artifactsDeferred.Load() && !bandwidth.Metered() {
+		go a.uploadDeferredArtifacts(ctx)
+	}
+}
+
+func (a *Agent) status() models.Heartbeat {
+	hb := models.Heartbeat{
+		AgentID:        a.config.AgentID,
+		Version:        version.Version,
+		UptimeSeconds:  int64(time.Since(a.startedAt).Seconds()),
+		RunningJobs:    []string{},
+		QueuedJobs:     []string{},
+		OutboxDepth:    int(a.outbox.Load()),
+		ActiveEndpoint: a.comm.ActiveEndpoint(),
+		Capabilities:   capabilities(a.config),
+		Load:           system.CollectLoad(),
+		SentAt:         clock.Now().UTC(),
+		SentAtLocal:    time.Now().UTC(),
+		Metered:        bandwidth.Metered(),
+	}
+	if skew, known, alert := a.checkClockSkew(); known {
+		ms := skew.Milliseconds()
+		hb.ClockSkewMillis = &ms
+		hb.ClockSkewAlert = alert
+	}
+
+	a.mu.Lock()
+	for id, state := range a.jobs {
+		if state == jobRunning {
+			hb.RunningJobs = append(hb.RunningJobs, id)
+		} else {
+			hb.QueuedJobs = append(hb.QueuedJobs, id)
+		}
+	}
+	lastPoll := a.lastPollAt
+	if a.longPoll != nil && a.longPoll.LastPoll().After(lastPoll) {
+		lastPoll = a.longPoll.LastPoll()
+	}
+	if !lastPoll.IsZero() {
+		t := lastPoll.UTC()
+		hb.LastPollAt = &t
+	}
+	if !a.lastInventoryAt.IsZero() {
+		t := a.lastInventoryAt.UTC()
+		hb.LastInventoryAt = &t
+	}
+	a.mu.Unlock()
+
+	sort.Strings(hb.RunningJobs)
+	sort.Strings(hb.QueuedJobs)
+	return hb
+}
@@ -0,0 +1,91 @@
+package agent
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/sentineledge/agent/internal/bandwidth"
+	"github.com/sentineledge/agent/internal/communicator"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// progressInterval es el tiempo mínimo entre eventos de progreso de un
+// job; con enlace medido se usa meteredProgressInterval, el progreso no es
+// urgente
+const (
+	progressInterval        = 5 * time.Second
+	meteredProgressInterval = time.Minute
+)
+
+// progressThrottle reenvía al servidor el progreso de un job, como máximo
+// un evento cada progressInterval. Si llegan varios en ese lapso solo se
+// envía el último.
+type progressThrottle struct {
+	ctx  context.Context
+	comm communicator.Transport
+
+	mu      sync.Mutex
+	pending *models.Progress
+	last    time.Time
+	timer   *time.Timer
+	stopped bool
+}
+
+func newProgressThrottle(ctx context.Context, comm communicator.Transport) *progressThrottle {
+	return &progressThrottle{ctx: ctx, comm: comm}
+}
+
+func (t *progressThrottle) push(p models.Progress) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return
+	}
+	t.pending = &p
+	if t.timer != nil {
+		// Ya hay un envío programado, saldrá con el último evento
+		return
+	}
+	interval := progressInterval
+	if bandwidth.Metered() {
+		interval = meteredProgressInterval
+	}
+	wait := interval - time.Since(t.last)
+	if wait < 0 {
+		wait = 0
+	}
+	t.timer = time.AfterFunc(wait, t.flush)
+}
+
+func (t *progressThrottle) flush() {
+	t.mu.Lock()
+	p := t.pending
+	t.pending = nil
+	t.timer = nil
+	t.last = time.Now()
+	stopped := t.stopped
+	t.mu.Unlock()
+
+	if p == nil || stopped {
+		return
+	}
+	if err := t.comm.ReportProgress(t.ctx, *p); err != nil && t.ctx.Err() == nil {
+		log.Printf("Error reporting progress for job %s: %v", p.JobID, err)
+	}
+}
+
+// stop descarta eventos pendientes; se llama cuando el job terminó
+func (t *progressThrottle) stop() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.stopped = true
+	t.pending = nil
+	if t.timer != nil {
+		t.timer.Stop()
+		t.timer = nil
+	}
+}
@@ -0,0 +1,93 @@
+package agent
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/sentineledge/agent/internal/communicator"
+)
+
+const (
+	// Después de recibir un comando se pregunta más seguido un rato,
+	// porque suelen llegar en ráfagas
+	fastPollInterval = 5 * time.Second
+	fastPollWindow   = 2 * time.Minute
+
+	// Techo de la espera entre polls, también para lo que pida el servidor
+	maxPollBackoff = communicator.MaxRetryAfter
+)
+
+// pollSchedule decide cuánto esperar hasta el siguiente poll: backoff
+// exponencial ante fallos, Retry-After y sugerencias del servidor, modo
+// rápido tras recibir comandos, y siempre con jitter para no sincronizar
+// a toda la flota
+type pollSchedule struct {
+	base       time.Duration
+	failures   int
+	retryAfter time.Duration
+	hint       time.Duration
+	fastUntil  time.Time
+}
+
+func newPollSchedule(base time.Duration) *pollSchedule {
+	return &pollSchedule{base: base}
+}
+
+func (s *pollSchedule) setBase(base time.Duration) {
+	s.base = base
+}
+
+// success registra un poll exitoso con la sugerencia del servidor, si hubo
+func (s *pollSchedule) success(gotCommands bool, hint time.Duration) {
+	s.failures = 0
+	s.hint = min(hint, maxPollBackoff)
+	if gotCommands {
+		s.fastUntil = time.Now().Add(fastPollWindow)
+	}
+}
+
+// failure registra un poll fallido; retryAfter es lo que pidió el servidor
+func (s *pollSchedule) failure(retryAfter time.Duration) {
+	s.failures++
+	s.retryAfter = min(retryAfter, maxPollBackoff)
+	s.hint = 0
+}
+
+func (s *pollSchedule) next() time.Duration {
+	if s.retryAfter > 0 {
+		// Respetar lo pedido; el jitter solo suma para no volver todos juntos
+		d := s.retryAfter
+		s.retryAfter = 0
+		return d + time.Duration(rand.Int63n(int64(d)/10+1))
+	}
+
+	if s.failures > 0 {
+		d := s.base
+		for i := 0; i < s.failures && d < maxPollBackoff; i++ {
+			d *= 2
+		}
+		if d > maxPollBackoff {
+			d = maxPollBackoff
+		}
+		return d + jitter(d, 0.2)
+	}
+
+	if s.hint > 0 {
+		return s.hint + jitter(s.hint, 0.1)
+	}
+
+	if time.Now().Before(s.fastUntil) && fastPollInterval < s.base {
+		return fastPollInterval + jitter(fastPollInterval, 0.1)
+	}
+
+	return s.base + jitter(s.base, 0.1)
+}
+
+// jitter retorna un valor aleatorio en ±frac*d
+func jitter(d time.Duration, frac float64) time.Duration {
+	span := int64(float64(d) * frac)
+	if span <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(2*span+1) - span)
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sentineledge/agent/internal/communicator"
+)
+
+// Backends de transporte
+const (
+	TransportHTTP = "http"
+	TransportMQTT = "mqtt"
+	TransportFile = "filedrop" // redes aisladas, bundles por directorio
+)
+
+// newTransport arma el transporte elegido en Transport con las
+// credenciales actuales, que pueden estar vacías si falta registrarse
+func newTransport(cfg *Config) (communicator.Transport, error) {
+	switch cfg.Transport {
+	case TransportHTTP, "":
+		comm := communicator.New(cfg.ServerURLs, cfg.AgentToken, cfg.AgentID)
+		comm.SetCompressThreshold(cfg.CompressThreshold)
+		comm.SetSigningSecret(cfg.SigningSecret)
+		comm.SetRequireSignedResponses(cfg.RequireSignedResponses)
+		comm.SetBatchWindow(time.Duration(cfg.ResultBatchMillis) * time.Millisecond)
+		comm.SetTimeouts(cfg.Timeouts)
+		loadCertificate(cfg, comm)
+		return comm, nil
+	case TransportMQTT:
+		if cfg.MQTTBroker == "" {
+			return nil, fmt.Errorf("transport %q requires MQTTBroker", TransportMQTT)
+		}
+		comm := communicator.NewMQTT(communicator.MQTTOptions{
+			Broker:      cfg.MQTTBroker,
+			Username:    cfg.MQTTUsername,
+			Password:    cfg.MQTTPassword,
+			TopicPrefix: cfg.MQTTTopicPrefix,
+			TenantID:    cfg.TenantID,
+		}, cfg.AgentToken, cfg.AgentID)
+		comm.SetSigningSecret(cfg.SigningSecret)
+		return comm, nil
+	case TransportFile:
+		key, err := communicator.ParseServerKey(cfg.FileDropServerKey)
+		if err != nil {
+			return nil, err
+		}
+		return communicator.NewFileDrop(communicator.FileDropOptions{
+			Inbox:     cfg.FileDropInbox,
+			Outbox:    cfg.FileDropOutbox,
+			ServerKey: key,
+			StateDir:  cfg.DataDir,
+		}, cfg.AgentToken, cfg.AgentID)
+	}
+	return nil, fmt.Errorf("unknown transport %q", cfg.Transport)
+}
+
+// pushTransport indica si el transporte entrega los comandos apenas llegan
+// por su cuenta, sin importar DeliveryMode
+func (cfg *Config) pushTransport() bool {
+	return cfg.Transport == TransportMQTT || cfg.Transport == TransportFile
+}
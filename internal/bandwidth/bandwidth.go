@@ -0,0 +1,283 @@
+// Package bandwidth limita el ancho de banda que usa el agente. En sitios
+// remotos con enlaces satelitales o LTE un inventario o un artefacto
+// grande puede saturar el enlace; las subidas y bajadas pasan por un token
+// bucket global cuyo límite puede cambiar según el horario.
+package bandwidth
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Options es la configuración de la sección Bandwidth de agent.yaml. Los
+// límites van en kilobits por segundo; 0 es sin límite.
+type Options struct {
+	UploadKbps   int
+	DownloadKbps int
+	// Metered marca el enlace como medido: las transferencias que pueden
+	// esperar se postergan hasta que deje de serlo
+	Metered  bool
+	Schedule []Rule
+}
+
+// Rule son los límites dentro de una franja horaria, en hora local. La
+// primera regla que coincide gana; fuera de todas rigen los de Options.
+type Rule struct {
+	Days         []string // "mon".."sun"; vacío es todos los días
+	From         string   // "08:00"
+	To           string   // "18:00"; si es menor que From la franja cruza la medianoche
+	UploadKbps   int
+	DownloadKbps int
+}
+
+// Direction es el sentido de una transferencia
+type Direction int
+
+const (
+	Upload Direction = iota
+	Download
+)
+
+// minBurst es lo mínimo que se deja pasar de una vez, para no partir las
+// lecturas en pedazos diminutos con límites bajos
+const minBurst = 4 << 10
+
+type rule struct {
+	days     map[time.Weekday]bool
+	from, to int // minutos desde la medianoche
+	up, down rate.Limit
+}
+
+var (
+	mu          sync.Mutex
+	defaultUp   rate.Limit = rate.Inf
+	defaultDown rate.Limit = rate.Inf
+	rules       []rule
+
+	limiters = [2]*rate.Limiter{
+		Upload:   rate.NewLimiter(rate.Inf, minBurst),
+		Download: rate.NewLimiter(rate.Inf, minBurst),
+	}
+	metered atomic.Bool
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday, "wed": time.Wednesday,
+	"thu": time.Thursday, "fri": time.Friday, "sat": time.Saturday,
+}
+
+// Configure aplica los límites y el horario. Si una regla es inválida
+// retorna error y no cambia nada.
+func Configure(opts Options) error {
+	parsed := make([]rule, 0, len(opts.Schedule))
+	for i, r := range opts.Schedule {
+		pr := rule{up: kbps(r.UploadKbps), down: kbps(r.DownloadKbps)}
+		var err error
+		if pr.from, err = parseClock(r.From); err != nil {
+			return fmt.Errorf("bandwidth schedule rule %d: %w", i+1, err)
+		}
+		if pr.to, err = parseClock(r.To); err != nil {
+			return fmt.Errorf("bandwidth schedule rule %d: %w", i+1, err)
+		}
+		if len(r.Days) > 0 {
+			pr.days = make(map[time.Weekday]bool)
+			for _, d := range r.Days {
+				key := strings.ToLower(strings.TrimSpace(d))
+				if len(key) > 3 {
+					key = key[:3] // "monday" también vale
+				}
+				wd, ok := weekdays[key]
+				if !ok {
+					return fmt.Errorf("bandwidth schedule rule %d: unknown day %q", i+1, d)
+				}
+				pr.days[wd] = true
+			}
+		}
+		parsed = append(parsed, pr)
+	}
+
+	mu.Lock()
+	defaultUp, defaultDown = kbps(opts.UploadKbps), kbps(opts.DownloadKbps)
+	rules = parsed
+	mu.Unlock()
+	metered.Store(opts.Metered)
+	apply(time.Now())
+	return nil
+}
+
+// kbps convierte kilobits por segundo a bytes por segundo
+func kbps(n int) rate.Limit {
+	if n <= 0 {
+		return rate.Inf
+	}
+	return rate.Limit(n * 1000 / 8)
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (r *rule) matches(now time.Time) bool {
+	minute := now.Hour()*60 + now.Minute()
+	day := now.Weekday()
+	if r.from > r.to && minute < r.to {
+		// Parte de la franja que empezó el día anterior
+		day = (day + 6) % 7
+	}
+	if r.days != nil && !r.days[day] {
+		return false
+	}
+	if r.from <= r.to {
+		return minute >= r.from && minute < r.to
+	}
+	return minute >= r.from || minute < r.to
+}
+
+// apply ajusta los limitadores a la franja vigente en now
+func apply(now time.Time) {
+	mu.Lock()
+	up, down := defaultUp, defaultDown
+	for i := range rules {
+		if rules[i].matches(now) {
+			up, down = rules[i].up, rules[i].down
+			break
+		}
+	}
+	mu.Unlock()
+
+	for dir, limit := range [2]rate.Limit{Upload: up, Download: down} {
+		l := limiters[dir]
+		if l.Limit() == limit {
+			continue
+		}
+		burst := minBurst
+		if limit != rate.Inf && int(limit) > burst {
+			burst = int(limit)
+		}
+		l.SetLimit(limit)
+		l.SetBurst(burst)
+	}
+}
+
+// SetMetered marca el enlace como medido o no, ej. por una directiva del
+// servidor
+func SetMetered(m bool) {
+	metered.Store(m)
+}
+
+// Metered indica si el enlace está marcado como medido; las
+// transferencias que pueden esperar no deberían empezar
+func Metered() bool {
+	return metered.Load()
+}
+
+// TransferTime es lo que tarda pasar n bytes en dir con el límite vigente,
+// 0 sin límite. Sirve para estirar el plazo de una petición: la espera en
+// el limitador no es un servidor que no responde.
+func TransferTime(dir Direction, n int64) time.Duration {
+	apply(time.Now())
+	limit := limiters[dir].Limit()
+	if limit == rate.Inf || limit <= 0 || n <= 0 {
+		return 0
+	}
+	return time.Duration(float64(n) / float64(limit) * float64(time.Second))
+}
+
+// Limited indica si dir tiene un límite vigente
+func Limited(dir Direction) bool {
+	apply(time.Now())
+	return limiters[dir].Limit() != rate.Inf
+}
+
+// wait consume n bytes del limitador, de a tramos del burst
+func wait(ctx context.Context, dir Direction, n int) error {
+	apply(time.Now())
+	l := limiters[dir]
+	if l.Limit() == rate.Inf {
+		return nil
+	}
+	for n > 0 {
+		chunk := min(n, l.Burst())
+		if err := l.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+type reader struct {
+	ctx context.Context
+	r   io.Reader
+	dir Direction
+}
+
+// Reader limita la lectura de r al ancho de banda de dir hasta que se
+// cancele ctx
+func Reader(ctx context.Context, r io.Reader, dir Direction) io.Reader {
+	return &reader{ctx: ctx, r: r, dir: dir}
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	// Leer de a un burst como máximo, así el flujo es parejo en vez de
+	// leer mucho y esperar mucho
+	if l := limiters[r.dir]; l.Limit() != rate.Inf && len(p) > l.Burst() {
+		p = p[:l.Burst()]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if werr := wait(r.ctx, r.dir, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// Transport envuelve base para que los cuerpos de las peticiones cuenten
+// como subida y los de las respuestas como bajada
+func Transport(base http.RoundTripper) http.RoundTripper {
+	return &transport{base: base}
+}
+
+type transport struct {
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if req.Body != nil && req.Body != http.NoBody {
+		req = req.Clone(ctx)
+		req.Body = readCloser{Reader(ctx, req.Body, Upload), req.Body}
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = readCloser{Reader(ctx, resp.Body, Download), resp.Body}
+	return resp, nil
+}
+
+// CloseIdleConnections delega en el transporte de abajo, para forzar un
+// handshake nuevo al cambiar el certificado cliente
+func (t *transport) CloseIdleConnections() {
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
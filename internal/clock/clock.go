@@ -0,0 +1,73 @@
+// Package clock estima el desfase entre el reloj local y el del servidor.
+// Muchos equipos en campo tienen la hora corrida varios minutos; las horas
+// que el agente reporta, las de las firmas que envía y la vigencia de las
+// firmas del servidor se corrigen con esta estimación. Sale solo de la hora
+// firmada de respuestas cuya firma ya se verificó, no del header Date, que
+// cualquiera en el medio puede cambiar.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Cantidad de muestras recientes; la estimación es la mediana
+	maxSamples = 9
+	// Muestras necesarias antes de usar la estimación, así una sola
+	// respuesta con la hora mal no corre todas las horas
+	minSamples = 3
+	// Con más ida y vuelta que esto no se sabe en qué momento el servidor
+	// fechó la respuesta, ej. un long-poll retenido
+	maxSampleRTT = 5 * time.Second
+)
+
+var (
+	mu      sync.Mutex
+	samples []time.Duration
+	skew    time.Duration
+	known   bool
+)
+
+// Observe registra la hora del servidor de una respuesta a una petición
+// enviada en sent y recibida en received, ambas en hora local. serverTime
+// tiene resolución de segundos (timestamp de la firma), por eso se toma la
+// mitad del segundo como hora probable.
+func Observe(serverTime, sent, received time.Time) {
+	rtt := received.Sub(sent)
+	if serverTime.IsZero() || rtt < 0 || rtt > maxSampleRTT {
+		return
+	}
+	midpoint := sent.Add(rtt / 2)
+	offset := serverTime.Add(500 * time.Millisecond).Sub(midpoint)
+
+	mu.Lock()
+	defer mu.Unlock()
+	samples = append(samples, offset)
+	if len(samples) > maxSamples {
+		samples = samples[1:]
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	skew = sorted[len(sorted)/2]
+	known = len(samples) >= minSamples
+}
+
+// Skew retorna cuánto hay que sumarle a la hora local para obtener la del
+// servidor. ok es false si todavía no hay minSamples muestras.
+func Skew() (d time.Duration, ok bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	return skew, known
+}
+
+// Now retorna la hora local corregida con el desfase estimado, o la local
+// tal cual si no hay estimación
+func Now() time.Time {
+	d, ok := Skew()
+	if !ok {
+		return time.Now()
+	}
+	return time.Now().Add(d)
+}
@@ -0,0 +1,64 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func reset() {
+	mu.Lock()
+	defer mu.Unlock()
+	samples, skew, known = nil, 0, false
+}
+
+// observeOffset simula una respuesta con el reloj del servidor offset
+// adelante del local
+func observeOffset(offset time.Duration) {
+	sent := time.Now()
+	received := sent.Add(100 * time.Millisecond)
+	Observe(sent.Add(50*time.Millisecond+offset).Truncate(time.Second), sent, received)
+}
+
+func TestSkewNeedsMinimumSamples(t *testing.T) {
+	reset()
+	t.Cleanup(reset)
+
+	for i := 1; i < minSamples; i++ {
+		observeOffset(time.Hour)
+		if _, ok := Skew(); ok {
+			t.Fatalf("estimate used after %d sample(s)", i)
+		}
+		if d := time.Until(Now()); d.Abs() > time.Second {
+			t.Fatalf("Now corrected by %s before enough samples", d)
+		}
+	}
+	observeOffset(time.Hour)
+	if d, ok := Skew(); !ok || (d-time.Hour).Abs() > time.Second {
+		t.Fatalf("Skew = %s, %v; want about 1h", d, ok)
+	}
+}
+
+func TestSkewIsMedian(t *testing.T) {
+	reset()
+	t.Cleanup(reset)
+
+	for _, offset := range []time.Duration{2 * time.Minute, time.Hour, 2 * time.Minute, -time.Hour, 2 * time.Minute} {
+		observeOffset(offset)
+	}
+	if d, _ := Skew(); (d - 2*time.Minute).Abs() > time.Second {
+		t.Fatalf("Skew = %s, want about 2m despite outliers", d)
+	}
+}
+
+func TestObserveIgnoresSlowResponses(t *testing.T) {
+	reset()
+	t.Cleanup(reset)
+
+	sent := time.Now()
+	for i := 0; i < minSamples; i++ {
+		Observe(sent.Add(time.Hour), sent, sent.Add(maxSampleRTT+time.Second))
+	}
+	if _, ok := Skew(); ok {
+		t.Fatal("learned skew from responses slower than maxSampleRTT")
+	}
+}
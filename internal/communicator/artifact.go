@@ -0,0 +1,200 @@
+package communicator
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// UploadArtifact sube un archivo producido por un job como multipart a
+// POST /commands/{id}/artifacts. resty arma en memoria cualquier body que
+// no sea un buffer, así que el cuerpo se escribe en un archivo temporal,
+// comprimido si el servidor lo acepta, y se envía con net/http leyéndolo
+// del disco en cada intento.
+func (c *Communicator) UploadArtifact(ctx context.Context, jobID, name string, r io.Reader) error {
+	enc, _ := c.compress.encoding.Load().(string)
+	if c.compress.threshold.Load() <= 0 {
+		enc = ""
+	}
+
+	body, contentType, err := spoolMultipart(name, r, enc)
+	if err != nil {
+		return fmt.Errorf("could not read artifact %s: %w", name, err)
+	}
+	defer os.Remove(body)
+
+	path := fmt.Sprintf("/commands/%s/artifacts", jobID)
+	code, err := c.upload(ctx, c.timeout().Artifact, path, body, contentType, enc)
+	if err == nil && code == http.StatusUnsupportedMediaType && enc != "" {
+		log.Println("Server rejected compressed body — disabling request compression")
+		c.compress.disable()
+		os.Remove(body)
+		if body, contentType, err = spoolMultipartFromStart(name, r); err != nil {
+			return fmt.Errorf("could not read artifact %s: %w", name, err)
+		}
+		defer os.Remove(body)
+		code, err = c.upload(ctx, c.timeout().Artifact, path, body, contentType, "")
+	}
+	if err != nil {
+		return fmt.Errorf("error uploading artifact %s: %w", name, err)
+	}
+	if code != http.StatusOK && code != http.StatusCreated {
+		return fmt.Errorf("server rejected artifact with code %d", code)
+	}
+	return nil
+}
+
+// spoolMultipartFromStart vuelve a leer el artefacto desde el principio
+// para reenviarlo sin comprimir; solo se puede si r es un archivo
+func spoolMultipartFromStart(name string, r io.Reader) (string, string, error) {
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return "", "", errors.New("artifact cannot be re-read to send uncompressed")
+	}
+	if _, err := s.Seek(0, io.SeekStart); err != nil {
+		return "", "", err
+	}
+	return spoolMultipart(name, r, "")
+}
+
+// spoolMultipart escribe el formulario multipart con el artefacto en un
+// archivo temporal y retorna su ruta y el Content-Type
+func spoolMultipart(name string, r io.Reader, enc string) (path, contentType string, err error) {
+	f, err := os.CreateTemp("", "se-artifact-*")
+	if err != nil {
+		return "", "", err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+
+	var w io.WriteCloser = nopWriteCloser{f}
+	switch enc {
+	case "zstd":
+		if w, err = zstd.NewWriter(f); err != nil {
+			return "", "", err
+		}
+	case "gzip":
+		w = gzip.NewWriter(f)
+	}
+
+	mw := multipart.NewWriter(w)
+	part, err := mw.CreateFormFile("file", name)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err = io.Copy(part, r); err != nil {
+		return "", "", err
+	}
+	if err = mw.Close(); err != nil {
+		return "", "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", "", err
+	}
+	return f.Name(), mw.FormDataContentType(), nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// upload envía el archivo body a path con la misma política de endpoints
+// y plazos que doWithFailover para una petición que no es idempotente:
+// solo se pasa al siguiente si no se llegó a conectar. Retorna el código
+// de respuesta; un 415 se retorna sin error para reintentar sin comprimir.
+func (c *Communicator) upload(ctx context.Context, timeout time.Duration, path, body, contentType, enc string) (int, error) {
+	info, err := os.Stat(body)
+	if err != nil {
+		return 0, err
+	}
+
+	timeout = uploadTimeout(timeout, info.Size())
+	for _, i := range c.endpoints.order() {
+		resp, msg, err := c.uploadTo(ctx, timeout, c.endpoints.url(i)+path, body, info.Size(), contentType, enc)
+		if err != nil {
+			if ctx.Err() != nil {
+				return 0, ctx.Err()
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("no response within %s: %w", timeout, err)
+			}
+			c.endpoints.failed(i, err.Error())
+			if notConnected(err) {
+				continue
+			}
+			return 0, &NetworkError{Err: err}
+		}
+
+		code := resp.StatusCode
+		if code >= 500 {
+			c.endpoints.failed(i, fmt.Sprintf("server responded %d", code))
+		} else {
+			c.endpoints.succeeded(i)
+		}
+		if perr := protocolError(code, resp.Header); perr != nil {
+			return code, perr
+		}
+		if code >= 400 && code != http.StatusUnsupportedMediaType {
+			return code, &StatusError{StatusCode: code, Body: strings.TrimSpace(msg)}
+		}
+		return code, nil
+	}
+	return 0, &NetworkError{Err: errors.New("no server endpoint reachable")}
+}
+
+// uploadTo hace un intento contra url. El error es solo de transporte; el
+// cuerpo de la respuesta se retorna leído, hasta maxErrorBody.
+func (c *Communicator) uploadTo(ctx context.Context, timeout time.Duration, url, body string, size int64, contentType, enc string) (*http.Response, string, error) {
+	attemptCtx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	f, err := os.Open(body)
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequestWithContext(attemptCtx, http.MethodPost, url, f)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+	req.ContentLength = size
+	req.GetBody = func() (io.ReadCloser, error) { return os.Open(body) }
+	req.Header.Set("Content-Type", contentType)
+	if enc != "" {
+		req.Header.Set("Content-Encoding", enc)
+	}
+	if _, token := c.credentials(); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if err := c.signRequest(nil, req); err != nil {
+		f.Close()
+		return nil, "", err
+	}
+
+	resp, err := c.client.GetClient().Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	msg, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	if err != nil {
+		return nil, "", err
+	}
+	return resp, string(msg), nil
+}
@@ -0,0 +1,170 @@
+package communicator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sentineledge/agent/internal/bandwidth"
+)
+
+// readArtifact decodifica el formulario multipart de una subida y retorna
+// el nombre y el contenido del archivo
+func readArtifact(t *testing.T, r *http.Request) (string, []byte) {
+	t.Helper()
+	body := io.Reader(r.Body)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			t.Fatalf("gzip body: %v", err)
+		}
+		body = zr
+	}
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("content type: %v", err)
+	}
+	part, err := multipart.NewReader(body, params["boundary"]).NextPart()
+	if err != nil {
+		t.Fatalf("multipart: %v", err)
+	}
+	data, err := io.ReadAll(part)
+	if err != nil {
+		t.Fatalf("multipart body: %v", err)
+	}
+	return part.FileName(), data
+}
+
+func TestUploadArtifactCompressed(t *testing.T) {
+	content := bytes.Repeat([]byte("line of output\n"), 10000)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/commands/job-1/artifacts" {
+			t.Errorf("path = %s", r.URL.Path)
+		}
+		if r.Header.Get("Content-Encoding") != "gzip" {
+			t.Errorf("Content-Encoding = %q, want gzip", r.Header.Get("Content-Encoding"))
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Authorization = %q", r.Header.Get("Authorization"))
+		}
+		if name, data := readArtifact(t, r); name != "out.log" || !bytes.Equal(data, content) {
+			t.Errorf("got %s with %d bytes, want out.log with %d", name, len(data), len(content))
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	c := New([]string{srv.URL}, "token", "agent-1")
+	c.compress.encoding.Store("gzip")
+	if err := c.UploadArtifact(context.Background(), "job-1", "out.log", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUploadArtifactRetriesUncompressedAfter415(t *testing.T) {
+	var attempts atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		if r.Header.Get("Content-Encoding") != "" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		if _, data := readArtifact(t, r); string(data) != "data" {
+			t.Errorf("content = %q", data)
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	c := New([]string{srv.URL}, "token", "agent-1")
+	c.compress.encoding.Store("gzip")
+	if err := c.UploadArtifact(context.Background(), "job-1", "out.log", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("attempts = %d, want 2", n)
+	}
+	if enc, _ := c.compress.encoding.Load().(string); enc != "" {
+		t.Errorf("compression still %q after a 415", enc)
+	}
+}
+
+func TestUploadArtifactFailover(t *testing.T) {
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+
+	var backup atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backup.Add(1)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	c := New([]string{deadURL, srv.URL}, "token", "agent-1")
+	if err := c.UploadArtifact(context.Background(), "job-1", "out.log", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+	if backup.Load() != 1 {
+		t.Errorf("backup endpoint got %d uploads, want 1", backup.Load())
+	}
+}
+
+func TestUploadArtifactNoFailoverOnServerError(t *testing.T) {
+	var backup atomic.Int32
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer primary.Close()
+	secondary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		backup.Add(1)
+	}))
+	defer secondary.Close()
+
+	c := New([]string{primary.URL, secondary.URL}, "token", "agent-1")
+	err := c.UploadArtifact(context.Background(), "job-1", "out.log", strings.NewReader("data"))
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("err = %v, want a 500 StatusError", err)
+	}
+	if backup.Load() != 0 {
+		t.Error("a processed upload was sent again to the backup endpoint")
+	}
+}
+
+func TestUploadTimeoutCoversThrottling(t *testing.T) {
+	// 20000 bytes/s: 60000 bytes tardan unos 2s, bastante más que el plazo
+	if err := bandwidth.Configure(bandwidth.Options{UploadKbps: 160}); err != nil {
+		t.Fatal(err)
+	}
+	defer bandwidth.Configure(bandwidth.Options{})
+
+	content := make([]byte, 60000)
+	rand.Read(content)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, data := readArtifact(t, r); len(data) != len(content) {
+			t.Errorf("got %d bytes, want %d", len(data), len(content))
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+
+	c := New([]string{srv.URL}, "token", "agent-1")
+	timeouts := DefaultTimeouts
+	timeouts.Artifact = 500 * time.Millisecond
+	c.SetTimeouts(timeouts)
+	if err := c.UploadArtifact(context.Background(), "job-1", "dump.bin", bytes.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+}
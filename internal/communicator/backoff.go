@@ -0,0 +1,30 @@
+package communicator
+
+import (
+	"math/rand"
+	"time"
+)
+
+// backoff calcula esperas exponenciales con jitter para reconexiones
+type backoff struct {
+	min, max time.Duration
+	current  time.Duration
+}
+
+func newBackoff(min, max time.Duration) *backoff {
+	return &backoff{min: min, max: max, current: min}
+}
+
+// next retorna la espera actual con ±50% de jitter y duplica la siguiente
+func (b *backoff) next() time.Duration {
+	wait := b.current/2 + time.Duration(rand.Int63n(int64(b.current)))
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+	return wait
+}
+
+func (b *backoff) reset() {
+	b.current = b.min
+}
@@ -0,0 +1,217 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// DefaultBatchWindow es cuánto se juntan resultados antes de enviarlos.
+// Sin batch por defecto: contra un servidor sin /commands/results/batch
+// cada resultado esperaría la ventana y un 404 antes de enviarse solo, así
+// que se activa con ResultBatchMillis donde el servidor lo soporta.
+const DefaultBatchWindow = time.Duration(0)
+
+const (
+	maxBatchSize = 50
+	// Con un servidor sin endpoint de batch se vuelve a probar cada tanto,
+	// por si lo actualizaron
+	batchRetryUnsupported = time.Hour
+)
+
+// ResultAck es la confirmación del servidor para un resultado del batch.
+// Status sigue los códigos HTTP: 200 aceptado, 404 job desconocido, etc.;
+// sin Status cuenta como aceptado salvo que traiga Error.
+type ResultAck struct {
+	JobID  string `json:"job_id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReportResults envía varios resultados en POST /commands/results/batch y
+// retorna la confirmación de cada uno
+func (c *Communicator) ReportResults(ctx context.Context, results []models.Result) ([]ResultAck, error) {
+	var body struct {
+		Acks []ResultAck `json:"acks"`
+	}
+	resp, err := c.do(ctx, c.timeout().Result, resty.MethodPost, "/commands/results/batch",
+		func(r *resty.Request) {
+			r.SetBody(map[string]any{"results": results}).SetResult(&body)
+		})
+
+	if err != nil {
+		return nil, fmt.Errorf("error reporting results: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("server rejected results with code %d", resp.StatusCode())
+	}
+
+	return body.Acks, nil
+}
+
+// resultBatcher junta los resultados que terminan dentro de una ventana y
+// los envía juntos. Cada ReportResult espera la confirmación de su propio
+// resultado, así un ítem rechazado vuelve a su llamador para reintentarse
+// solo, sin repetir el batch entero.
+type resultBatcher struct {
+	c *Communicator
+
+	mu               sync.Mutex
+	window           time.Duration
+	queue            []*queuedResult
+	timer            *time.Timer
+	unsupportedUntil time.Time
+}
+
+type queuedResult struct {
+	ctx    context.Context
+	result models.Result
+	done   chan error
+}
+
+// SetBatchWindow cambia la ventana de batch de resultados; 0, el valor
+// por defecto, envía cada resultado por separado
+func (c *Communicator) SetBatchWindow(d time.Duration) {
+	c.batch.mu.Lock()
+	defer c.batch.mu.Unlock()
+	c.batch.window = d
+}
+
+// PendingResults es la cantidad de resultados esperando el próximo batch
+func (c *Communicator) PendingResults() int {
+	c.batch.mu.Lock()
+	defer c.batch.mu.Unlock()
+	return len(c.batch.queue)
+}
+
+// submit encola el resultado y espera su confirmación o que se cancele
+// ctx. batched es false si el batch está desactivado y hay que enviarlo por
+// separado.
+func (b *resultBatcher) submit(ctx context.Context, result models.Result) (batched bool, err error) {
+	b.mu.Lock()
+	if b.window <= 0 || time.Now().Before(b.unsupportedUntil) {
+		b.mu.Unlock()
+		return false, nil
+	}
+
+	q := &queuedResult{ctx: ctx, result: result, done: make(chan error, 1)}
+	b.queue = append(b.queue, q)
+	switch {
+	case len(b.queue) >= maxBatchSize:
+		b.stopTimer()
+		go b.flush()
+	case b.timer == nil:
+		b.timer = time.AfterFunc(b.window, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case err := <-q.done:
+		return true, err
+	case <-ctx.Done():
+		return true, ctx.Err()
+	}
+}
+
+// stopTimer se llama con mu tomado
+func (b *resultBatcher) stopTimer() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+}
+
+func (b *resultBatcher) flush() {
+	b.mu.Lock()
+	items := b.queue
+	b.queue = nil
+	b.stopTimer()
+	b.mu.Unlock()
+
+	if len(items) == 0 {
+		return
+	}
+	if len(items) == 1 {
+		items[0].done <- b.c.reportResult(items[0].ctx, items[0].result)
+		return
+	}
+
+	ctx, cancel := batchContext(items)
+	defer cancel()
+
+	results := make([]models.Result, len(items))
+	for i, q := range items {
+		results[i] = q.result
+	}
+
+	acks, err := b.c.ReportResults(ctx, results)
+	var statusErr *StatusError
+	if errors.Is(err, ErrNotFound) || (errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusMethodNotAllowed) {
+		log.Printf("Server has no batch result endpoint — reporting results one by one for %s", batchRetryUnsupported)
+		b.mu.Lock()
+		b.unsupportedUntil = time.Now().Add(batchRetryUnsupported)
+		b.mu.Unlock()
+		for _, q := range items {
+			q.done <- b.c.reportResult(q.ctx, q.result)
+		}
+		return
+	}
+	if err != nil {
+		for _, q := range items {
+			q.done <- err
+		}
+		return
+	}
+
+	byJob := make(map[string]ResultAck, len(acks))
+	for _, ack := range acks {
+		byJob[ack.JobID] = ack
+	}
+	accepted := 0
+	for _, q := range items {
+		ack, ok := byJob[q.result.JobID]
+		switch {
+		case !ok:
+			q.done <- fmt.Errorf("error reporting result: %w: no acknowledgement in batch response", ErrServer)
+		case ack.Status == 0 && ack.Error != "":
+			q.done <- fmt.Errorf("error reporting result: %w: %s", ErrServer, ack.Error)
+		case ack.Status == 0, ack.Status >= 200 && ack.Status < 300:
+			accepted++
+			q.done <- nil
+		default:
+			q.done <- fmt.Errorf("server rejected result: %w", &StatusError{StatusCode: ack.Status, Body: ack.Error})
+		}
+	}
+	log.Printf("%d/%d results reported in batch", accepted, len(items))
+}
+
+// batchContext se cancela cuando ya nadie espera el batch: cuando se
+// cancelaron los contextos de todos sus resultados
+func batchContext(items []*queuedResult) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var waiting atomic.Int32
+	waiting.Store(int32(len(items)))
+	stops := make([]func() bool, len(items))
+	for i, q := range items {
+		stops[i] = context.AfterFunc(q.ctx, func() {
+			if waiting.Add(-1) == 0 {
+				cancel()
+			}
+		})
+	}
+	return ctx, func() {
+		for _, stop := range stops {
+			stop()
+		}
+		cancel()
+	}
+}
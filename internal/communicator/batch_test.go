@@ -0,0 +1,100 @@
+package communicator
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// resultServer cuenta las peticiones por path y confirma todo
+func resultServer(t *testing.T, batch bool) (*httptest.Server, func() map[string]int) {
+	t.Helper()
+	var mu sync.Mutex
+	hits := make(map[string]int)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits[r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/commands/result":
+			w.WriteHeader(http.StatusOK)
+		case "/commands/results/batch":
+			if !batch {
+				http.NotFound(w, r)
+				return
+			}
+			var body struct {
+				Results []models.Result `json:"results"`
+			}
+			json.NewDecoder(r.Body).Decode(&body)
+			var resp struct {
+				Acks []ResultAck `json:"acks"`
+			}
+			for _, res := range body.Results {
+				resp.Acks = append(resp.Acks, ResultAck{JobID: res.JobID, Status: http.StatusOK})
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() map[string]int {
+		mu.Lock()
+		defer mu.Unlock()
+		return map[string]int{"single": hits["/commands/result"], "batch": hits["/commands/results/batch"]}
+	}
+}
+
+func reportConcurrently(t *testing.T, c *Communicator, n int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := c.ReportResult(context.Background(), models.Result{JobID: string(rune('a' + i))}); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestResultsAreNotBatchedByDefault(t *testing.T) {
+	srv, hits := resultServer(t, true)
+	c := New([]string{srv.URL}, "token", "agent-1")
+
+	reportConcurrently(t, c, 3)
+	if h := hits(); h["single"] != 3 || h["batch"] != 0 {
+		t.Errorf("got %d single and %d batch requests, want 3 single", h["single"], h["batch"])
+	}
+}
+
+func TestResultsBatchedWhenEnabled(t *testing.T) {
+	srv, hits := resultServer(t, true)
+	c := New([]string{srv.URL}, "token", "agent-1")
+	c.SetBatchWindow(200 * time.Millisecond)
+
+	reportConcurrently(t, c, 3)
+	if h := hits(); h["single"] != 0 || h["batch"] != 1 {
+		t.Errorf("got %d single and %d batch requests, want 1 batch", h["single"], h["batch"])
+	}
+}
+
+func TestBatchFallsBackWithoutEndpoint(t *testing.T) {
+	srv, hits := resultServer(t, false)
+	c := New([]string{srv.URL}, "token", "agent-1")
+	c.SetBatchWindow(200 * time.Millisecond)
+
+	reportConcurrently(t, c, 3)
+	reportConcurrently(t, c, 2)
+	if h := hits(); h["single"] != 5 || h["batch"] != 1 {
+		t.Errorf("got %d single and %d batch requests, want 5 single after 1 failed batch", h["single"], h["batch"])
+	}
+}
@@ -0,0 +1,201 @@
+// Package commtest tiene un Transport en memoria para probar el agente sin
+// servidor. No se puede elegir desde la configuración.
+package commtest
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/sentineledge/agent/internal/communicator"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// Memory es un Transport en memoria para pruebas: los comandos se encolan
+// con Enqueue y todo lo que el agente envía queda guardado para revisarlo
+type Memory struct {
+	mu          sync.Mutex
+	agentID     string
+	token       string
+	registered  int
+	pending     []models.Command
+	results     []models.Result
+	progress    []models.Progress
+	heartbeats  []models.Heartbeat
+	inventories []*models.Inventory
+	artifacts   map[string][]byte // "<jobID>/<name>" -> contenido
+	directives  models.HeartbeatResponse
+	failNext    error
+}
+
+var _ communicator.Transport = (*Memory)(nil)
+
+func NewMemory() *Memory {
+	return &Memory{artifacts: make(map[string][]byte)}
+}
+
+// Enqueue agrega comandos que el agente recibirá en el próximo poll
+func (m *Memory) Enqueue(cmds ...models.Command) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending = append(m.pending, cmds...)
+}
+
+// SetDirectives fija lo que responden los heartbeats
+func (m *Memory) SetDirectives(d models.HeartbeatResponse) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.directives = d
+}
+
+// FailNext hace que la próxima llamada retorne err, ej. ErrUnauthorized
+func (m *Memory) FailNext(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failNext = err
+}
+
+// Results retorna una copia de los resultados reportados
+func (m *Memory) Results() []models.Result {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]models.Result(nil), m.results...)
+}
+
+// Progress retorna una copia de los eventos de progreso reportados
+func (m *Memory) Progress() []models.Progress {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]models.Progress(nil), m.progress...)
+}
+
+// Heartbeats retorna una copia de los heartbeats recibidos
+func (m *Memory) Heartbeats() []models.Heartbeat {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]models.Heartbeat(nil), m.heartbeats...)
+}
+
+// Inventories retorna los inventarios recibidos
+func (m *Memory) Inventories() []*models.Inventory {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*models.Inventory(nil), m.inventories...)
+}
+
+// Artifact retorna el contenido de un artefacto subido
+func (m *Memory) Artifact(jobID, name string) ([]byte, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.artifacts[jobID+"/"+name]
+	return data, ok
+}
+
+// Credentials retorna el ID y token que el agente está usando
+func (m *Memory) Credentials() (agentID, token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.agentID, m.token
+}
+
+// takeFailure retorna el error de ctx si se canceló o consume el
+// programado con FailNext; se llama con mu tomado
+func (m *Memory) takeFailure(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	err := m.failNext
+	m.failNext = nil
+	return err
+}
+
+func (m *Memory) Register(ctx context.Context, req communicator.RegisterRequest) (*communicator.RegisterResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.takeFailure(ctx); err != nil {
+		return nil, err
+	}
+	m.registered++
+	return &communicator.RegisterResponse{
+		ID:    fmt.Sprintf("memory-agent-%d", m.registered),
+		Token: fmt.Sprintf("memory-token-%d", m.registered),
+	}, nil
+}
+
+func (m *Memory) PollCommands(ctx context.Context) (*communicator.PollResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.takeFailure(ctx); err != nil {
+		return nil, err
+	}
+	cmds := m.pending
+	m.pending = nil
+	return &communicator.PollResponse{Commands: cmds}, nil
+}
+
+func (m *Memory) ReportResult(ctx context.Context, result models.Result) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.takeFailure(ctx); err != nil {
+		return err
+	}
+	m.results = append(m.results, result)
+	return nil
+}
+
+func (m *Memory) ReportProgress(ctx context.Context, p models.Progress) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.takeFailure(ctx); err != nil {
+		return err
+	}
+	m.progress = append(m.progress, p)
+	return nil
+}
+
+func (m *Memory) Heartbeat(ctx context.Context, hb models.Heartbeat) (*models.HeartbeatResponse, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.takeFailure(ctx); err != nil {
+		return nil, err
+	}
+	m.heartbeats = append(m.heartbeats, hb)
+	d := m.directives
+	return &d, nil
+}
+
+func (m *Memory) SendInventory(ctx context.Context, inv *models.Inventory) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.takeFailure(ctx); err != nil {
+		return err
+	}
+	m.inventories = append(m.inventories, inv)
+	return nil
+}
+
+func (m *Memory) UploadArtifact(ctx context.Context, jobID, name string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("could not read artifact %s: %w", name, err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.takeFailure(ctx); err != nil {
+		return err
+	}
+	m.artifacts[jobID+"/"+name] = data
+	return nil
+}
+
+func (m *Memory) SetCredentials(agentID, token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.agentID = agentID
+	m.token = token
+}
+
+func (m *Memory) ActiveEndpoint() string {
+	return "memory"
+}
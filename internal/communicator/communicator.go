@@ -1,71 +1,258 @@
 package communicator
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"log"
 	"os"
 	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-resty/resty/v2"
+	"github.com/sentineledge/agent/internal/bandwidth"
+	"github.com/sentineledge/agent/internal/network"
+	"github.com/sentineledge/agent/internal/version"
 	"github.com/sentineledge/agent/pkg/models"
 )
 
 type Communicator struct {
-	client  *resty.Client
+	client    *resty.Client
+	endpoints *endpointSet
+	tlsConfig *tls.Config
+	cert      atomic.Pointer[tls.Certificate] // certificado cliente mTLS, si hay
+	compress  compression
+	batch     resultBatcher
+	timeouts  atomic.Pointer[Timeouts]
+	serverSignatures
+
+	credMu  sync.RWMutex
+	token   string
 	agentID string
 }
 
 type RegisterRequest struct {
-	Hostname string `json:"hostname"`
-	OS       string `json:"os"`
-	Version  string `json:"version"`
-	TenantID string `json:"tenant_id"`
-	APIKey   string `json:"api_key"`
+	Hostname     string               `json:"hostname"`
+	OS           string               `json:"os"`
+	Version      string               `json:"version"`
+	TenantID     string               `json:"tenant_id"`
+	APIKey       string               `json:"api_key"`
+	CSR          string               `json:"csr,omitempty"` // PEM; el servidor emite el certificado cliente
+	Capabilities *models.Capabilities `json:"capabilities,omitempty"`
+	Fingerprint  *models.Fingerprint  `json:"fingerprint,omitempty"` // el servidor lo usa para reconocer un equipo ya registrado
+	Tags         []string             `json:"tags,omitempty"`
+	Site         string               `json:"site,omitempty"`
+	Group        string               `json:"group,omitempty"`
+	ClonedFrom   string               `json:"cloned_from,omitempty"` // AgentID heredado de la máquina original
 }
 
 type RegisterResponse struct {
-	ID      string `json:"id"`
-	Token   string `json:"token"`
-	Message string `json:"message"`
+	ID            string `json:"id"`
+	Token         string `json:"token"`
+	SigningSecret string `json:"signing_secret,omitempty"` // llave de las firmas HMAC; no vuelve a viajar
+	Certificate   string `json:"certificate,omitempty"`    // PEM
+	Message       string `json:"message"`
+	Reattached    bool   `json:"reattached,omitempty"` // el ID ya existía para este fingerprint
 }
 
-func New(serverURL, token, agentID string) *Communicator {
-	client := resty.New().
-		SetBaseURL(serverURL).
+// New crea el cliente para la lista ordenada de endpoints del servidor;
+// el primero es el primario
+func New(serverURLs []string, token, agentID string) *Communicator {
+	c := &Communicator{
+		endpoints: newEndpointSet(serverURLs),
+		token:     token,
+		agentID:   agentID,
+	}
+	transport := network.PinnedTransport()
+	transport.TLSClientConfig.GetClientCertificate = c.clientCertificate
+	c.tlsConfig = transport.TLSClientConfig
+
+	c.client = resty.New().
+		SetTransport(bandwidth.Transport(transport)).
 		SetHeader("Content-Type", "application/json").
-		SetRetryCount(3)
+		SetRetryCount(3).
+		AddRetryCondition(retryable).
+		SetPreRequestHook(c.signRequest)
+	c.compress.setThreshold(DefaultCompressThreshold)
+	c.batch = resultBatcher{c: c, window: DefaultBatchWindow}
+	c.SetTimeouts(DefaultTimeouts)
+
+	return c
+}
+
+// SetCompressThreshold cambia desde qué tamaño se comprimen los bodies;
+// 0 desactiva la compresión
+func (c *Communicator) SetCompressThreshold(n int) {
+	c.compress.setThreshold(n)
+}
+
+// SetCredentials cambia el ID y token usados en las peticiones siguientes,
+// tras rotar el token o volver a registrarse
+func (c *Communicator) SetCredentials(agentID, token string) {
+	c.credMu.Lock()
+	defer c.credMu.Unlock()
+	c.agentID = agentID
+	c.token = token
+}
+
+func (c *Communicator) credentials() (agentID, token string) {
+	c.credMu.RLock()
+	defer c.credMu.RUnlock()
+	return c.agentID, c.token
+}
 
-	if token != "" {
-		client.SetHeader("Authorization", "Bearer "+token)
+// SetCertificate cambia el certificado cliente usado en las conexiones
+// nuevas; se llama al cargar la identidad y tras cada renovación
+func (c *Communicator) SetCertificate(cert *tls.Certificate) {
+	c.cert.Store(cert)
+	// Forzar handshake nuevo con el certificado actualizado
+	if t, ok := c.client.GetClient().Transport.(interface{ CloseIdleConnections() }); ok {
+		t.CloseIdleConnections()
 	}
+}
 
-	return &Communicator{
-		client:  client,
-		agentID: agentID,
+func (c *Communicator) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	if cert := c.cert.Load(); cert != nil {
+		return cert, nil
 	}
+	// Sin certificado: el servidor decide si acepta solo el token
+	return &tls.Certificate{}, nil
 }
 
-// Register registra el agente en el servidor y retorna id y token
-func Register(serverURL, tenantID, apiKey string) (*RegisterResponse, error) {
-	hostname, _ := os.Hostname()
+// ActiveEndpoint retorna la URL del servidor en uso
+func (c *Communicator) ActiveEndpoint() string {
+	return c.endpoints.Active()
+}
+
+// Endpoints retorna el estado de cada endpoint configurado
+func (c *Communicator) Endpoints() []EndpointHealth {
+	return c.endpoints.snapshot()
+}
+
+// do ejecuta la petición contra el endpoint activo. Ante un error de
+// conexión, un 5xx o si vence timeout prueba los demás endpoints en orden y
+// se queda con el primero que responda. Los códigos de error y los fallos
+// de red o de decodificación se retornan como los errores tipados de
+// errors.go; si se canceló ctx, su error.
+func (c *Communicator) do(ctx context.Context, timeout time.Duration, method, path string, prepare func(*resty.Request)) (*resty.Response, error) {
+	_, token := c.credentials()
+
+	build := func(compress bool) func(*resty.Request) {
+		return func(r *resty.Request) {
+			if token != "" {
+				r.SetAuthToken(token)
+			}
+			if prepare != nil {
+				prepare(r)
+			}
+			if compress {
+				c.compress.apply(r)
+			}
+		}
+	}
+
+	resp, err := doWithFailover(ctx, c.client, c.endpoints, timeout, method, path, build(true))
+	if err == nil && resp.StatusCode() == 415 && resp.Request.Header.Get("Content-Encoding") != "" {
+		// El servidor dejó de aceptar bodies comprimidos; reenviar sin comprimir
+		log.Println("Server rejected compressed body — disabling request compression")
+		c.compress.disable()
+		resp, err = doWithFailover(ctx, c.client, c.endpoints, timeout, method, path, build(false))
+	}
+	if err == nil {
+		c.compress.learn(resp)
+		if perr := checkProtocol(resp); perr != nil {
+			return resp, perr
+		}
+	}
+	return resp, responseError(resp, err)
+}
+
+// doWithFailover ejecuta la petición en cada endpoint hasta que uno
+// responda. timeout vale para cada intento por separado, estirado con lo
+// que tarda subir el body con el límite de ancho de banda: un endpoint
+// colgado no le quita el plazo al siguiente. Una petición que no es
+// idempotente solo pasa al siguiente endpoint si no llegó a conectarse;
+// un 5xx o un timeout pueden haber dejado el efecto hecho en el servidor.
+func doWithFailover(ctx context.Context, client *resty.Client, endpoints *endpointSet, timeout time.Duration, method, path string, prepare func(*resty.Request)) (*resty.Response, error) {
+	var resp *resty.Response
+	var err error
+	safe := idempotent(method, path)
 
-	client := resty.New().SetBaseURL(serverURL)
+	for _, i := range endpoints.order() {
+		req := client.R()
+		if prepare != nil {
+			prepare(req)
+		}
+		attemptTimeout := uploadTimeout(timeout, bodySize(req))
+		attemptCtx, cancel := withTimeout(ctx, attemptTimeout)
+		req.SetContext(attemptCtx)
+		// resty ya leyó el cuerpo al retornar, se puede cancelar
+		resp, err = req.Execute(method, endpoints.url(i)+path)
+		cancel()
 
-	req := RegisterRequest{
-		Hostname: hostname,
-		OS:       runtime.GOOS,
-		Version:  "0.1.0",
-		TenantID: tenantID,
-		APIKey:   apiKey,
+		switch {
+		case err != nil && resp != nil && resp.RawResponse != nil:
+			// El endpoint respondió; el problema es el cuerpo, no la conexión
+			endpoints.succeeded(i)
+			return resp, err
+		case err != nil:
+			if ctx.Err() != nil {
+				// Cancelado por quien llamó, no es culpa del endpoint
+				return resp, err
+			}
+			if errors.Is(err, context.DeadlineExceeded) {
+				err = fmt.Errorf("no response within %s: %w", attemptTimeout, err)
+			}
+			endpoints.failed(i, err.Error())
+			if !safe && !notConnected(err) {
+				return resp, err
+			}
+		case resp.StatusCode() >= 500:
+			endpoints.failed(i, fmt.Sprintf("server responded %d", resp.StatusCode()))
+			if !safe {
+				return resp, nil
+			}
+		default:
+			endpoints.succeeded(i)
+			return resp, nil
+		}
 	}
 
+	// Todos fallaron: se retorna el último resultado
+	return resp, err
+}
+
+// Register registra el agente en el servidor y retorna id y token.
+// Hostname, OS y Version se completan aquí.
+func Register(ctx context.Context, serverURLs []string, req RegisterRequest) (*RegisterResponse, error) {
+	return register(ctx, serverURLs, DefaultTimeouts.Register, req)
+}
+
+func register(ctx context.Context, serverURLs []string, timeout time.Duration, req RegisterRequest) (*RegisterResponse, error) {
+	hostname, _ := os.Hostname()
+
+	client := resty.New().
+		SetTransport(bandwidth.Transport(network.PinnedTransport()))
+
+	req.Hostname = hostname
+	req.OS = runtime.GOOS
+	req.Version = version.Version
+
 	var resp RegisterResponse
-	r, err := client.R().
-		SetBody(req).
-		SetResult(&resp).
-		Post("/agents/register")
+	r, err := doWithFailover(ctx, client, newEndpointSet(serverURLs), timeout, resty.MethodPost, "/agents/register",
+		func(r *resty.Request) {
+			r.SetBody(req).SetResult(&resp)
+		})
 
-	if err != nil {
+	if err == nil {
+		if perr := checkProtocol(r); perr != nil {
+			return nil, perr
+		}
+	}
+	if err := responseError(r, err); err != nil {
 		return nil, fmt.Errorf("Error registering agent: %w", err)
 	}
 
@@ -73,17 +260,30 @@ func Register(serverURL, tenantID, apiKey string) (*RegisterResponse, error) {
 		return nil, fmt.Errorf("Server rejected registration with code %d: %s", r.StatusCode(), r.String())
 	}
 
-	log.Printf("Agent successfully registered. ID: %s", resp.ID)
+	if resp.Reattached {
+		log.Printf("Server recognized this machine — reattached to existing agent %s", resp.ID)
+	} else {
+		log.Printf("Agent successfully registered. ID: %s", resp.ID)
+	}
 	return &resp, nil
 }
 
+// PollResponse son los comandos pendientes y cuándo sugiere el servidor
+// volver a preguntar
+type PollResponse struct {
+	Commands []models.Command
+	NextPoll time.Duration // 0 si el servidor no envió X-Next-Poll
+}
+
 // PollCommands pregunta al servidor si hay comandos pendientes
-func (c *Communicator) PollCommands() ([]models.Command, error) {
+func (c *Communicator) PollCommands(ctx context.Context) (*PollResponse, error) {
 	var commands []models.Command
+	agentID, _ := c.credentials()
 
-	resp, err := c.client.R().
-		SetResult(&commands).
-		Get(fmt.Sprintf("/commands/pending/%s", c.agentID))
+	resp, err := c.do(ctx, c.timeout().Poll, resty.MethodGet, fmt.Sprintf("/commands/pending/%s", agentID),
+		func(r *resty.Request) {
+			r.SetResult(&commands)
+		})
 
 	if err != nil {
 		return nil, fmt.Errorf("error in poll: %w", err)
@@ -93,14 +293,32 @@ func (c *Communicator) PollCommands() ([]models.Command, error) {
 		return nil, fmt.Errorf("server responded %d", resp.StatusCode())
 	}
 
-	return commands, nil
+	if err := c.verifyResponse(resp); err != nil {
+		return nil, err
+	}
+
+	return &PollResponse{
+		Commands: commands,
+		NextPoll: parseRetryAfter(resp.Header().Get(NextPollHeader)),
+	}, nil
+}
+
+// ReportResult envía el resultado de un comando al servidor. Los que
+// terminan cerca se juntan en un batch; la llamada retorna cuando el
+// servidor confirmó este resultado.
+func (c *Communicator) ReportResult(ctx context.Context, result models.Result) error {
+	if batched, err := c.batch.submit(ctx, result); batched {
+		return err
+	}
+	return c.reportResult(ctx, result)
 }
 
-// ReportResult envía el resultado de un comando al servidor
-func (c *Communicator) ReportResult(result models.Result) error {
-	resp, err := c.client.R().
-		SetBody(result).
-		Post("/commands/result")
+// reportResult envía un solo resultado a POST /commands/result
+func (c *Communicator) reportResult(ctx context.Context, result models.Result) error {
+	resp, err := c.do(ctx, c.timeout().Result, resty.MethodPost, "/commands/result",
+		func(r *resty.Request) {
+			r.SetBody(result)
+		})
 
 	if err != nil {
 		return fmt.Errorf("error reporting result: %w", err)
@@ -114,25 +332,120 @@ func (c *Communicator) ReportResult(result models.Result) error {
 	return nil
 }
 
-// Heartbeat le dice al servidor que el agente sigue vivo
-func (c *Communicator) Heartbeat() error {
-	_, err := c.client.R().
-		Post(fmt.Sprintf("/agents/%s/heartbeat", c.agentID))
-	return err
+// ReportProgress envía un evento de avance de un job en ejecución
+func (c *Communicator) ReportProgress(ctx context.Context, p models.Progress) error {
+	resp, err := c.do(ctx, c.timeout().Progress, resty.MethodPost, fmt.Sprintf("/commands/%s/progress", p.JobID),
+		func(r *resty.Request) {
+			r.SetBody(p)
+		})
+
+	if err != nil {
+		return fmt.Errorf("error reporting progress: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return fmt.Errorf("server rejected progress with code %d", resp.StatusCode())
+	}
+
+	return nil
+}
+
+// RenewCertificate envía un CSR nuevo y retorna el certificado emitido.
+// También sirve para que un agente registrado antes de mTLS obtenga uno.
+func (c *Communicator) RenewCertificate(ctx context.Context, csr string) (string, error) {
+	var result struct {
+		Certificate string `json:"certificate"`
+	}
+	agentID, _ := c.credentials()
+
+	resp, err := c.do(ctx, c.timeout().Certificate, resty.MethodPost, fmt.Sprintf("/agents/%s/certificate", agentID),
+		func(r *resty.Request) {
+			r.SetBody(map[string]string{"csr": csr}).SetResult(&result)
+		})
+
+	if err != nil {
+		return "", fmt.Errorf("error renewing certificate: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return "", fmt.Errorf("server rejected certificate request with code %d", resp.StatusCode())
+	}
+
+	if result.Certificate == "" {
+		return "", fmt.Errorf("server returned no certificate")
+	}
+
+	return result.Certificate, nil
+}
+
+// TokenResponse es el token nuevo emitido por el servidor
+type TokenResponse struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at,omitempty"`
+}
+
+// RefreshToken pide un token nuevo autenticándose con el actual. El token
+// anterior deja de valer cuando el servidor lo decida, así que el nuevo
+// debe guardarse antes de usarse.
+func (c *Communicator) RefreshToken(ctx context.Context) (*TokenResponse, error) {
+	var result TokenResponse
+	agentID, _ := c.credentials()
+
+	resp, err := c.do(ctx, c.timeout().Token, resty.MethodPost, fmt.Sprintf("/agents/%s/token/refresh", agentID),
+		func(r *resty.Request) {
+			r.SetResult(&result)
+		})
+
+	if err != nil {
+		return nil, fmt.Errorf("error refreshing token: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("server rejected token refresh with code %d", resp.StatusCode())
+	}
+
+	if result.Token == "" {
+		return nil, fmt.Errorf("server returned no token")
+	}
+
+	return &result, nil
+}
+
+// Heartbeat le dice al servidor que el agente sigue vivo y retorna las
+// directivas que el servidor quiera enviarle
+func (c *Communicator) Heartbeat(ctx context.Context, hb models.Heartbeat) (*models.HeartbeatResponse, error) {
+	var directives models.HeartbeatResponse
+	agentID, _ := c.credentials()
+
+	resp, err := c.do(ctx, c.timeout().Heartbeat, resty.MethodPost, fmt.Sprintf("/agents/%s/heartbeat", agentID),
+		func(r *resty.Request) {
+			r.SetBody(hb).SetResult(&directives)
+		})
+
+	if err != nil {
+		return nil, fmt.Errorf("error sending heartbeat: %w", err)
+	}
+
+	if resp.StatusCode() != 200 && resp.StatusCode() != 204 {
+		return nil, fmt.Errorf("server rejected heartbeat with code %d", resp.StatusCode())
+	}
+
+	return &directives, nil
 }
 
 // SendInventory envía el inventario del agente al servidor
-func (c *Communicator) SendInventory(inv *models.Inventory) error {
-	resp, err := c.client.R().
-		SetBody(inv).
-		Post("/agents/inventory")
+func (c *Communicator) SendInventory(ctx context.Context, inv *models.Inventory) error {
+	resp, err := c.do(ctx, c.timeout().Inventory, resty.MethodPost, "/agents/inventory",
+		func(r *resty.Request) {
+			r.SetBody(inv)
+		})
 
 	if err != nil {
 		return fmt.Errorf("error sending inventory: %w", err)
 	}
 
 	if resp.StatusCode() != 200 {
-		return fmt.Errorf("server rejected inventory with code %d: %s", resp.StatusCode(), resp.String())
+		return fmt.Errorf("server rejected inventory with code %d", resp.StatusCode())
 	}
 
 	log.Printf("Inventory sent successfully — %d software items, %d disks, %d NICs",
@@ -0,0 +1,120 @@
+package communicator
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultCompressThreshold es el tamaño desde el cual se comprime el body
+const DefaultCompressThreshold = 8 * 1024
+
+// Tras un 415 no se vuelve a comprimir durante este tiempo aunque el
+// servidor siga anunciando Accept-Encoding, ej. un balanceador que lo
+// anuncia delante de un backend que no descomprime
+const compressDisableFor = time.Hour
+
+// compression recuerda qué codificación acepta el servidor para los bodies
+// de las peticiones. El servidor la anuncia con Accept-Encoding en sus
+// respuestas (RFC 7694); hasta verla se envía sin comprimir, así los
+// servidores viejos siguen funcionando. Aplica a todo body que pase por
+// Communicator.do: resultados (con la salida de los comandos), lotes,
+// inventario y artefactos.
+type compression struct {
+	threshold     atomic.Int64
+	encoding      atomic.Value // string: "", "gzip" o "zstd"
+	disabledUntil atomic.Int64 // UnixNano; hasta entonces se ignora Accept-Encoding
+}
+
+func (cp *compression) setThreshold(n int) {
+	cp.threshold.Store(int64(n))
+}
+
+// learn toma la preferencia del servidor de una respuesta
+func (cp *compression) learn(resp *resty.Response) {
+	accept := resp.Header().Get("Accept-Encoding")
+	if accept == "" || time.Now().UnixNano() < cp.disabledUntil.Load() {
+		return
+	}
+	switch {
+	case strings.Contains(accept, "zstd"):
+		cp.encoding.Store("zstd")
+	case strings.Contains(accept, "gzip"):
+		cp.encoding.Store("gzip")
+	default:
+		cp.encoding.Store("")
+	}
+}
+
+// disable se usa cuando el servidor rechaza un body comprimido con 415
+func (cp *compression) disable() {
+	cp.disabledUntil.Store(time.Now().Add(compressDisableFor).UnixNano())
+	cp.encoding.Store("")
+}
+
+// apply comprime el body de r si supera el umbral. Retorna la codificación
+// usada o "" si se dejó igual.
+func (cp *compression) apply(r *resty.Request) string {
+	enc, _ := cp.encoding.Load().(string)
+	threshold := cp.threshold.Load()
+	if enc == "" || threshold <= 0 || r.Body == nil {
+		return ""
+	}
+
+	var raw []byte
+	switch body := r.Body.(type) {
+	case []byte:
+		raw = body
+	case string:
+		raw = []byte(body)
+	default:
+		var err error
+		if raw, err = json.Marshal(body); err != nil {
+			return ""
+		}
+	}
+	if int64(len(raw)) < threshold {
+		return ""
+	}
+
+	compressed, err := compressBytes(enc, raw)
+	if err != nil || len(compressed) >= len(raw) {
+		return ""
+	}
+
+	r.SetBody(compressed)
+	r.SetHeader("Content-Encoding", enc)
+	return enc
+}
+
+func compressBytes(enc string, raw []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch enc {
+	case "zstd":
+		w, err := zstd.NewWriter(&buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(raw); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,165 @@
+package communicator
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// primaryRetryInterval es cada cuánto se intenta volver al endpoint
+// primario mientras se usa uno secundario
+const primaryRetryInterval = 10 * time.Minute
+
+// EndpointHealth es el estado de un endpoint del servidor
+type EndpointHealth struct {
+	URL         string
+	Failures    int // fallos consecutivos
+	LastError   string
+	LastFailure time.Time
+}
+
+// endpointSet es la lista ordenada de endpoints del servidor. Se usa el
+// activo hasta que falle; el primero de la lista es el primario.
+type endpointSet struct {
+	mu             sync.Mutex
+	health         []EndpointHealth
+	active         int
+	lastPrimaryTry time.Time
+}
+
+func newEndpointSet(urls []string) *endpointSet {
+	e := &endpointSet{}
+	for _, u := range urls {
+		u = strings.TrimRight(strings.TrimSpace(u), "/")
+		if u != "" {
+			e.health = append(e.health, EndpointHealth{URL: u})
+		}
+	}
+	return e
+}
+
+// order retorna los índices a probar: el activo y luego el resto en orden.
+// Cada primaryRetryInterval el primario va primero para intentar volver.
+func (e *endpointSet) order() []int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	n := len(e.health)
+	order := make([]int, 0, n)
+	if e.active != 0 && time.Since(e.lastPrimaryTry) >= primaryRetryInterval {
+		e.lastPrimaryTry = time.Now()
+		order = append(order, 0)
+	}
+	for i := 0; i < n; i++ {
+		idx := (e.active + i) % n
+		if len(order) > 0 && idx == order[0] {
+			continue
+		}
+		order = append(order, idx)
+	}
+	return order
+}
+
+func (e *endpointSet) url(i int) string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.health[i].URL
+}
+
+func (e *endpointSet) succeeded(i int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.health[i].Failures = 0
+	if i != e.active {
+		log.Printf("Switching server endpoint: %s -> %s", e.health[e.active].URL, e.health[i].URL)
+		e.active = i
+		if i != 0 {
+			e.lastPrimaryTry = time.Now()
+		}
+	}
+}
+
+func (e *endpointSet) failed(i int, reason string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.health[i].Failures++
+	e.health[i].LastError = reason
+	e.health[i].LastFailure = time.Now()
+}
+
+// Active retorna la URL del endpoint en uso
+func (e *endpointSet) Active() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.health[e.active].URL
+}
+
+func (e *endpointSet) snapshot() []EndpointHealth {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]EndpointHealth(nil), e.health...)
+}
+
+// Peticiones que no se pueden repetir en otro endpoint sin riesgo de
+// duplicar el efecto: un resultado reportado dos veces, dos registros, un
+// token rotado dos veces (el primero queda inválido) o un artefacto doble
+var nonIdempotentPaths = []string{
+	"/agents/register",
+	"/commands/result",
+	"/commands/results/batch",
+	"/token/refresh",
+	"/artifacts",
+}
+
+func idempotent(method, path string) bool {
+	if method == http.MethodGet || method == http.MethodHead {
+		return true
+	}
+	for _, suffix := range nonIdempotentPaths {
+		if strings.HasSuffix(path, suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// retryable decide si resty reintenta contra el mismo endpoint. Una
+// petición que no es idempotente solo se reenvía si no llegó a conectarse:
+// si el servidor la recibió, repetirla duplica un resultado o rota el
+// token dos veces.
+func retryable(resp *resty.Response, err error) bool {
+	if err == nil {
+		return false
+	}
+	if notConnected(err) {
+		return true
+	}
+	if resp == nil || resp.Request == nil {
+		return false
+	}
+	u, perr := url.Parse(resp.Request.URL)
+	if perr != nil {
+		return false
+	}
+	return idempotent(resp.Request.Method, u.Path)
+}
+
+// notConnected indica que la petición no llegó al servidor: falló la
+// resolución del nombre o la conexión
+func notConnected(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
@@ -0,0 +1,55 @@
+package communicator
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// droppingServer lee cada petición y corta la conexión sin responder,
+// como un servidor que se cae después de recibirla
+func droppingServer(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		io.Copy(io.Discard, r.Body)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		conn.Close()
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &hits
+}
+
+func TestNonIdempotentRequestNotResentAfterDrop(t *testing.T) {
+	srv, hits := droppingServer(t)
+	c := New([]string{srv.URL}, "token", "agent-1")
+
+	if err := c.ReportResult(context.Background(), models.Result{JobID: "job-1"}); err == nil {
+		t.Fatal("expected an error from a dropped connection")
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("server received the result %d times, want 1", n)
+	}
+}
+
+func TestIdempotentRequestRetriedAfterDrop(t *testing.T) {
+	srv, hits := droppingServer(t)
+	c := New([]string{srv.URL}, "token", "agent-1")
+
+	if _, err := c.PollCommands(context.Background()); err == nil {
+		t.Fatal("expected an error from a dropped connection")
+	}
+	if n := hits.Load(); n < 2 {
+		t.Errorf("poll sent %d time(s), want it retried", n)
+	}
+}
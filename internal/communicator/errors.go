@@ -0,0 +1,139 @@
+package communicator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/go-resty/resty/v2"
+)
+
+// Errores por modo de fallo; se comparan con errors.Is. Los tipos de abajo
+// llevan el detalle (código, cuerpo, error original).
+var (
+	// ErrUnauthorized indica que el servidor rechazó el token del agente (401)
+	ErrUnauthorized = errors.New("agent token rejected by server")
+	// ErrForbidden indica que el agente se autenticó pero no tiene permiso (403)
+	ErrForbidden = errors.New("request forbidden by server")
+	// ErrNotFound indica que el recurso no existe (404), ej. un agente borrado
+	ErrNotFound = errors.New("resource not found on server")
+	// ErrAgentDeleted indica que el servidor dijo explícitamente que el
+	// agente fue borrado: 410, o 404 con {"error":"agent_deleted"}
+	ErrAgentDeleted = errors.New("agent deleted on server")
+	// ErrRateLimited indica que el servidor pidió bajar el ritmo (429 o 503)
+	ErrRateLimited = errors.New("rate limited by server")
+	// ErrServer indica un error del servidor (5xx)
+	ErrServer = errors.New("server error")
+	// ErrNetwork indica que no se llegó a ningún endpoint
+	ErrNetwork = errors.New("server unreachable")
+	// ErrDecode indica que la respuesta llegó pero no se pudo interpretar
+	ErrDecode = errors.New("invalid server response")
+)
+
+// maxErrorBody es cuánto del cuerpo de una respuesta de error se guarda
+const maxErrorBody = 512
+
+// StatusError es una respuesta del servidor con código de error
+type StatusError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *StatusError) Error() string {
+	if e.Body != "" {
+		return fmt.Sprintf("server responded %d: %s", e.StatusCode, e.Body)
+	}
+	return fmt.Sprintf("server responded %d", e.StatusCode)
+}
+
+func (e *StatusError) Is(target error) bool {
+	if target == ErrAgentDeleted {
+		return e.agentDeleted()
+	}
+	return target == statusSentinel(e.StatusCode)
+}
+
+func (e *StatusError) agentDeleted() bool {
+	if e.StatusCode == http.StatusGone {
+		return true
+	}
+	if e.StatusCode != http.StatusNotFound {
+		return false
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	return json.Unmarshal([]byte(e.Body), &body) == nil && body.Error == "agent_deleted"
+}
+
+func statusSentinel(code int) error {
+	switch {
+	case code == http.StatusUnauthorized:
+		return ErrUnauthorized
+	case code == http.StatusForbidden:
+		return ErrForbidden
+	case code == http.StatusNotFound:
+		return ErrNotFound
+	case code == http.StatusTooManyRequests:
+		return ErrRateLimited
+	case code >= 500:
+		return ErrServer
+	}
+	return nil
+}
+
+// NetworkError envuelve un fallo de conexión, DNS, TLS o timeout
+type NetworkError struct {
+	Err error
+}
+
+func (e *NetworkError) Error() string { return fmt.Sprintf("%v: %v", ErrNetwork, e.Err) }
+
+func (e *NetworkError) Unwrap() error { return e.Err }
+
+func (e *NetworkError) Is(target error) bool { return target == ErrNetwork }
+
+// DecodeError envuelve un cuerpo de respuesta que no se pudo decodificar
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string { return fmt.Sprintf("%v: %v", ErrDecode, e.Err) }
+
+func (e *DecodeError) Unwrap() error { return e.Err }
+
+func (e *DecodeError) Is(target error) bool { return target == ErrDecode }
+
+// responseError convierte el resultado de una petición en uno de los
+// errores tipados, o nil si la respuesta es 2xx/3xx
+func responseError(resp *resty.Response, err error) error {
+	if errors.Is(err, context.Canceled) {
+		// Quien llamó abandonó la petición; no es un fallo de red
+		return err
+	}
+	if err != nil {
+		// Con respuesta HTTP de por medio lo que falló fue leer el cuerpo
+		if resp != nil && resp.RawResponse != nil {
+			return &DecodeError{Err: err}
+		}
+		return &NetworkError{Err: err}
+	}
+
+	code := resp.StatusCode()
+	switch {
+	case code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable:
+		return &RetryAfterError{
+			StatusCode: code,
+			RetryAfter: parseRetryAfter(resp.Header().Get("Retry-After")),
+		}
+	case code >= 400:
+		body := resp.String()
+		if len(body) > maxErrorBody {
+			body = body[:maxErrorBody] + "…"
+		}
+		return &StatusError{StatusCode: code, Body: body}
+	}
+	return nil
+}
@@ -0,0 +1,609 @@
+package communicator
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+const (
+	// fileDropStateFile guarda los IDs de bundles ya procesados
+	fileDropStateFile = "filedrop-seen.json"
+	// fileDropRegisterWait es cuánto se espera la respuesta de registro;
+	// los bundles pueden tardar días en ir y volver en un USB
+	fileDropRegisterWait = 72 * time.Hour
+	fileDropRescan       = time.Minute
+)
+
+// FileDropOptions configura el transporte por archivos
+type FileDropOptions struct {
+	Inbox     string            // de donde se leen los bundles del servidor
+	Outbox    string            // donde se escriben los bundles del agente
+	ServerKey ed25519.PublicKey // llave con la que el servidor firma sus bundles
+	StateDir  string            // donde se guarda fileDropStateFile
+}
+
+// Bundle es un archivo .json del inbox o del outbox. Payload es el JSON del
+// contenido; la firma cubre esos bytes exactos, así no hay que normalizar.
+// Los del servidor se firman con ed25519; los del agente con HMAC de la
+// llave derivada del token, como las peticiones HTTP.
+type Bundle struct {
+	Kind      string `json:"kind"`
+	AgentID   string `json:"agent_id,omitempty"`
+	CreatedAt string `json:"created_at"` // hora Unix, parte de la firma del agente
+	Payload   string `json:"payload"`    // base64
+	Signature string `json:"signature"`  // base64 (ed25519) o "v1=<hex>" (HMAC)
+}
+
+// serverPayload es el contenido de un bundle del servidor
+type serverPayload struct {
+	ID         string                    `json:"id"`
+	AgentID    string                    `json:"agent_id"`
+	Nonce      string                    `json:"nonce,omitempty"` // responde a un registro
+	ExpiresAt  time.Time                 `json:"expires_at"`
+	Commands   []models.Command          `json:"commands,omitempty"`
+	Directives *models.HeartbeatResponse `json:"directives,omitempty"`
+	Register   *RegisterResponse         `json:"register,omitempty"`
+}
+
+// FileDrop es un Transport para redes aisladas: los comandos llegan como
+// bundles firmados a un directorio vigilado (un USB, un share) y lo que el
+// agente reporta se escribe como bundles firmados en otro. Cada bundle del
+// servidor se procesa una sola vez aunque siga en el inbox, y los del
+// agente se escriben con rename para que nunca se copie uno a medias.
+//
+// Un bundle con comandos se da por procesado recién cuando el resultado
+// de todos ellos está en el outbox; si el agente se detiene antes, al
+// volver a arrancar lo lee de nuevo y corre los que faltaban.
+type FileDrop struct {
+	opts FileDropOptions
+
+	mu         sync.Mutex
+	agentID    string
+	token      string
+	seen       map[string]time.Time   // bundle ID -> vencimiento
+	open       map[string]*openBundle // bundles con resultados pendientes
+	bundles    map[string][]string    // job ID -> bundles que lo traen
+	pending    []models.Command       // comandos leídos y no entregados
+	rejected   map[string]time.Time   // archivo -> modtime, para no reportarlo en cada scan
+	directives *models.HeartbeatResponse
+	register   map[string]*RegisterResponse // nonce -> respuesta
+	watching   bool
+}
+
+// openBundle es un bundle leído cuyos comandos no tienen todos su
+// resultado en el outbox
+type openBundle struct {
+	expiresAt time.Time
+	jobs      map[string]bool // job IDs sin resultado escrito
+}
+
+var (
+	_ Transport = (*FileDrop)(nil)
+	_ Pusher    = (*FileDrop)(nil)
+)
+
+func NewFileDrop(opts FileDropOptions, token, agentID string) (*FileDrop, error) {
+	if opts.Inbox == "" || opts.Outbox == "" {
+		return nil, errors.New("file-drop transport needs inbox and outbox directories")
+	}
+	if len(opts.ServerKey) != ed25519.PublicKeySize {
+		return nil, errors.New("file-drop transport needs the server's ed25519 public key")
+	}
+	if err := os.MkdirAll(opts.Outbox, 0700); err != nil {
+		return nil, fmt.Errorf("could not create outbox: %w", err)
+	}
+
+	f := &FileDrop{
+		opts:     opts,
+		agentID:  agentID,
+		token:    token,
+		seen:     make(map[string]time.Time),
+		open:     make(map[string]*openBundle),
+		bundles:  make(map[string][]string),
+		rejected: make(map[string]time.Time),
+		register: make(map[string]*RegisterResponse),
+	}
+	f.loadSeen()
+	return f, nil
+}
+
+// ParseServerKey decodifica la llave pública del servidor en base64
+func ParseServerKey(b64 string) (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid server key: expected a base64 ed25519 public key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+func (f *FileDrop) loadSeen() {
+	data, err := os.ReadFile(filepath.Join(f.opts.StateDir, fileDropStateFile))
+	if err != nil {
+		return
+	}
+	if err := json.Unmarshal(data, &f.seen); err != nil {
+		log.Printf("Warning: ignoring corrupt %s: %v", fileDropStateFile, err)
+		f.seen = make(map[string]time.Time)
+	}
+}
+
+// saveSeen persiste los IDs procesados, sin los vencidos: un bundle vencido
+// se rechaza igual. Se llama con mu tomado.
+func (f *FileDrop) saveSeen() error {
+	now := time.Now()
+	for id, exp := range f.seen {
+		if now.After(exp) {
+			delete(f.seen, id)
+		}
+	}
+	data, err := json.Marshal(f.seen)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(f.opts.StateDir, fileDropStateFile), data)
+}
+
+// scan procesa los bundles nuevos del inbox. Los que no se pueden leer
+// todavía (a medio copiar) se reintentan en el próximo scan.
+func (f *FileDrop) scan() error {
+	entries, err := os.ReadDir(f.opts.Inbox)
+	if err != nil {
+		return &NetworkError{Err: fmt.Errorf("inbox unavailable: %w", err)}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changed := false
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(f.opts.Inbox, e.Name())
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		if mod, ok := f.rejected[path]; ok && mod.Equal(info.ModTime()) {
+			continue
+		}
+		p, err := f.readServerBundle(path)
+		if err != nil {
+			log.Printf("Skipping bundle %s: %v", e.Name(), err)
+			f.rejected[path] = info.ModTime()
+			continue
+		}
+		if p == nil {
+			continue
+		}
+		if len(p.Commands) == 0 {
+			f.seen[p.ID] = p.ExpiresAt
+			changed = true
+		} else {
+			ob := &openBundle{expiresAt: p.ExpiresAt, jobs: make(map[string]bool)}
+			for _, cmd := range p.Commands {
+				if !ob.jobs[cmd.ID] {
+					ob.jobs[cmd.ID] = true
+					f.bundles[cmd.ID] = append(f.bundles[cmd.ID], p.ID)
+				}
+			}
+			f.open[p.ID] = ob
+		}
+
+		if p.Register != nil && p.Nonce != "" {
+			f.register[p.Nonce] = p.Register
+		}
+		if p.Directives != nil {
+			f.directives = p.Directives
+		}
+		f.pending = append(f.pending, p.Commands...)
+		log.Printf("Bundle %s processed: %d command(s)", p.ID, len(p.Commands))
+	}
+
+	if changed {
+		if err := f.saveSeen(); err != nil {
+			log.Printf("Warning: could not save processed bundles: %v", err)
+		}
+	}
+	return nil
+}
+
+// resultWritten cierra los bundles que esperaban solo el resultado de
+// jobID y los guarda como procesados
+func (f *FileDrop) resultWritten(jobID string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	changed := false
+	for _, id := range f.bundles[jobID] {
+		ob, ok := f.open[id]
+		if !ok {
+			continue
+		}
+		delete(ob.jobs, jobID)
+		if len(ob.jobs) == 0 {
+			delete(f.open, id)
+			f.seen[id] = ob.expiresAt
+			changed = true
+		}
+	}
+	delete(f.bundles, jobID)
+
+	if changed {
+		if err := f.saveSeen(); err != nil {
+			log.Printf("Warning: could not save processed bundles: %v", err)
+		}
+	}
+}
+
+// readServerBundle valida un bundle del inbox. Retorna nil sin error si ya
+// se procesó o se está procesando, venció o es para otro agente. Se llama
+// con mu tomado.
+func (f *FileDrop) readServerBundle(path string) (*serverPayload, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, fmt.Errorf("invalid bundle: %w", err)
+	}
+	payload, err := base64.StdEncoding.DecodeString(b.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("invalid payload encoding: %w", err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(b.Signature)
+	if err != nil || !ed25519.Verify(f.opts.ServerKey, payload, sig) {
+		return nil, ErrBadSignature
+	}
+
+	var p serverPayload
+	if err := json.Unmarshal(payload, &p); err != nil {
+		return nil, &DecodeError{Err: err}
+	}
+	if p.ID == "" {
+		return nil, errors.New("bundle has no id")
+	}
+	if _, ok := f.seen[p.ID]; ok {
+		return nil, nil
+	}
+	if _, ok := f.open[p.ID]; ok {
+		return nil, nil
+	}
+	if time.Now().After(p.ExpiresAt) {
+		return nil, nil
+	}
+	// Las respuestas de registro van a un agente que aún no tiene ID
+	if p.AgentID != f.agentID && p.Register == nil {
+		return nil, nil
+	}
+	return &p, nil
+}
+
+// latestOnly son los tipos de bundle donde solo importa el último; se
+// sobrescriben en vez de acumular un archivo por envío
+var latestOnly = map[string]bool{"heartbeat": true, "inventory": true}
+
+// write firma y deja un bundle del agente en el outbox
+func (f *FileDrop) write(ctx context.Context, kind string, v any) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	agentID, token := f.credentials()
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	b := Bundle{
+		Kind:      kind,
+		AgentID:   agentID,
+		CreatedAt: ts,
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+	}
+	if token != "" {
+		b.Signature = signature(signingKey(token), []string{kind, agentID, ts}, payload)
+	}
+	data, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+
+	owner := agentID
+	if owner == "" {
+		owner = "unregistered"
+	}
+	name := fmt.Sprintf("%s-%s.json", kind, owner)
+	if !latestOnly[kind] {
+		suffix := make([]byte, 4)
+		rand.Read(suffix)
+		name = fmt.Sprintf("%s-%s-%s-%s.json", kind, owner, ts, hex.EncodeToString(suffix))
+	}
+	if err := writeFileAtomic(filepath.Join(f.opts.Outbox, name), data); err != nil {
+		return &NetworkError{Err: fmt.Errorf("could not write to outbox: %w", err)}
+	}
+	return nil
+}
+
+// writeFileAtomic escribe en un temporal con otra extensión y lo renombra,
+// así quien vigila el directorio nunca ve un .json incompleto
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+func (f *FileDrop) credentials() (agentID, token string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.agentID, f.token
+}
+
+// Register deja la solicitud en el outbox y espera en el inbox un bundle
+// firmado con la respuesta para el mismo nonce
+func (f *FileDrop) Register(ctx context.Context, req RegisterRequest) (*RegisterResponse, error) {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	nonce := hex.EncodeToString(raw)
+
+	hostname, _ := os.Hostname()
+	req.Hostname = hostname
+	err := f.write(ctx, "register", struct {
+		RegisterRequest
+		Nonce string `json:"nonce"`
+	}{req, nonce})
+	if err != nil {
+		return nil, fmt.Errorf("Error registering agent: %w", err)
+	}
+	log.Printf("Registration request written to %s — waiting for the response bundle (nonce %s)", f.opts.Outbox, nonce)
+
+	waitCtx, cancel := context.WithTimeout(ctx, fileDropRegisterWait)
+	defer cancel()
+	events := f.watch(waitCtx)
+	rescan := time.NewTicker(fileDropRescan)
+	defer rescan.Stop()
+
+	for {
+		if err := f.scan(); err != nil {
+			log.Printf("File-drop: %v", err)
+		}
+		f.mu.Lock()
+		resp := f.register[nonce]
+		f.mu.Unlock()
+		if resp != nil {
+			log.Printf("Agent successfully registered. ID: %s", resp.ID)
+			return resp, nil
+		}
+
+		select {
+		case <-waitCtx.Done():
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("Error registering agent: %w", &NetworkError{Err: errors.New("no registration response bundle")})
+		case <-events:
+		case <-rescan.C:
+		}
+	}
+}
+
+// watch avisa por el canal cuando cambia algo en el inbox. Si fsnotify no
+// está disponible (algunos shares de red) el canal nunca dispara y queda
+// el rescan periódico.
+func (f *FileDrop) watch(ctx context.Context) <-chan struct{} {
+	events := make(chan struct{}, 1)
+	w, err := fsnotify.NewWatcher()
+	if err == nil {
+		err = w.Add(f.opts.Inbox)
+	}
+	if err != nil {
+		log.Printf("Warning: cannot watch %s (%v) — scanning every %s", f.opts.Inbox, err, fileDropRescan)
+		if w != nil {
+			w.Close()
+		}
+		return events
+	}
+
+	go func() {
+		defer w.Close()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if ev.Has(fsnotify.Create) || ev.Has(fsnotify.Write) || ev.Has(fsnotify.Rename) {
+					select {
+					case events <- struct{}{}:
+					default:
+					}
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Inbox watch error: %v", err)
+			}
+		}
+	}()
+	return events
+}
+
+// PollCommands revisa el inbox y retorna los comandos nuevos
+func (f *FileDrop) PollCommands(ctx context.Context) (*PollResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := f.scan(); err != nil {
+		return nil, err
+	}
+	return &PollResponse{Commands: f.takePending()}, nil
+}
+
+func (f *FileDrop) takePending() []models.Command {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	cmds := f.pending
+	f.pending = nil
+	return cmds
+}
+
+func (f *FileDrop) ReportResult(ctx context.Context, result models.Result) error {
+	if err := f.write(ctx, "result", result); err != nil {
+		return fmt.Errorf("error reporting result: %w", err)
+	}
+	f.resultWritten(result.JobID)
+	log.Printf("Job %s result written to outbox", result.JobID)
+	return nil
+}
+
+// ReportProgress no hace nada: el progreso ya no sirve cuando el bundle
+// llega al servidor
+func (f *FileDrop) ReportProgress(context.Context, models.Progress) error {
+	return nil
+}
+
+// Heartbeat escribe el estado y retorna las últimas directivas recibidas
+// en un bundle, una sola vez
+func (f *FileDrop) Heartbeat(ctx context.Context, hb models.Heartbeat) (*models.HeartbeatResponse, error) {
+	if err := f.write(ctx, "heartbeat", hb); err != nil {
+		return nil, fmt.Errorf("error sending heartbeat: %w", err)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	d := f.directives
+	f.directives = nil
+	if d == nil {
+		d = &models.HeartbeatResponse{}
+	}
+	return d, nil
+}
+
+func (f *FileDrop) SendInventory(ctx context.Context, inv *models.Inventory) error {
+	if err := f.write(ctx, "inventory", inv); err != nil {
+		return fmt.Errorf("error sending inventory: %w", err)
+	}
+	log.Println("Inventory written to outbox")
+	return nil
+}
+
+// UploadArtifact copia el archivo al outbox y escribe un bundle firmado con
+// su nombre y SHA-256, así el servidor puede verificar la copia
+func (f *FileDrop) UploadArtifact(ctx context.Context, jobID, name string, r io.Reader) error {
+	agentID, _ := f.credentials()
+	file := fmt.Sprintf("artifact-%s-%s-%s", agentID, jobID, filepath.Base(name))
+	path := filepath.Join(f.opts.Outbox, file)
+
+	out, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("error uploading artifact %s: %w", name, &NetworkError{Err: err})
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(out, h), r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return fmt.Errorf("error uploading artifact %s: %w", name, err)
+	}
+
+	return f.write(ctx, "artifact", map[string]string{
+		"job_id": jobID,
+		"name":   name,
+		"file":   file,
+		"sha256": hex.EncodeToString(h.Sum(nil)),
+	})
+}
+
+func (f *FileDrop) SetCredentials(agentID, token string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.agentID = agentID
+	f.token = token
+}
+
+func (f *FileDrop) ActiveEndpoint() string {
+	return "file://" + filepath.ToSlash(f.opts.Outbox)
+}
+
+// NewPush procesa los bundles apenas aparecen en el inbox
+func (f *FileDrop) NewPush() CommandStream {
+	return &fileDropStream{f: f}
+}
+
+type fileDropStream struct {
+	f *FileDrop
+}
+
+func (s *fileDropStream) Run(ctx context.Context, out chan<- models.Command) {
+	events := s.f.watch(ctx)
+	s.f.mu.Lock()
+	s.f.watching = true
+	s.f.mu.Unlock()
+	defer func() {
+		s.f.mu.Lock()
+		s.f.watching = false
+		s.f.mu.Unlock()
+	}()
+
+	rescan := time.NewTicker(fileDropRescan)
+	defer rescan.Stop()
+	for {
+		if err := s.f.scan(); err != nil {
+			log.Printf("File-drop: %v", err)
+		}
+		for _, cmd := range s.f.takePending() {
+			select {
+			case out <- cmd:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-events:
+		case <-rescan.C:
+		}
+	}
+}
+
+func (s *fileDropStream) Connected() bool {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	return s.f.watching
+}
@@ -0,0 +1,217 @@
+package communicator
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+type fileDropFixture struct {
+	t      *testing.T
+	opts   FileDropOptions
+	server ed25519.PrivateKey
+}
+
+func newFileDropFixture(t *testing.T) *fileDropFixture {
+	t.Helper()
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	opts := FileDropOptions{
+		Inbox:     filepath.Join(dir, "inbox"),
+		Outbox:    filepath.Join(dir, "outbox"),
+		ServerKey: pub,
+		StateDir:  dir,
+	}
+	if err := os.MkdirAll(opts.Inbox, 0700); err != nil {
+		t.Fatal(err)
+	}
+	return &fileDropFixture{t: t, opts: opts, server: priv}
+}
+
+// open arma el transporte como al arrancar el agente
+func (fx *fileDropFixture) open(agentID string) *FileDrop {
+	fx.t.Helper()
+	f, err := NewFileDrop(fx.opts, "token", agentID)
+	if err != nil {
+		fx.t.Fatal(err)
+	}
+	return f
+}
+
+// drop deja en el inbox un bundle del servidor firmado con key
+func (fx *fileDropFixture) drop(name string, p serverPayload, key ed25519.PrivateKey) {
+	fx.t.Helper()
+	if p.ExpiresAt.IsZero() {
+		p.ExpiresAt = time.Now().Add(time.Hour)
+	}
+	payload, err := json.Marshal(p)
+	if err != nil {
+		fx.t.Fatal(err)
+	}
+	data, err := json.Marshal(Bundle{
+		Kind:      "commands",
+		Payload:   base64.StdEncoding.EncodeToString(payload),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(key, payload)),
+	})
+	if err != nil {
+		fx.t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fx.opts.Inbox, name), data, 0600); err != nil {
+		fx.t.Fatal(err)
+	}
+}
+
+func pollIDs(t *testing.T, f *FileDrop) []string {
+	t.Helper()
+	resp, err := f.PollCommands(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, cmd := range resp.Commands {
+		ids = append(ids, cmd.ID)
+	}
+	return ids
+}
+
+func TestFileDropBundleSeenOnlyAfterResults(t *testing.T) {
+	fx := newFileDropFixture(t)
+	fx.drop("b1.json", serverPayload{
+		ID:       "b1",
+		AgentID:  "agent-1",
+		Commands: []models.Command{{ID: "job-1"}, {ID: "job-2"}},
+	}, fx.server)
+
+	f := fx.open("agent-1")
+	if ids := pollIDs(t, f); len(ids) != 2 {
+		t.Fatalf("first poll got %v, want job-1 and job-2", ids)
+	}
+	if ids := pollIDs(t, f); len(ids) != 0 {
+		t.Fatalf("bundle delivered twice in the same run: %v", ids)
+	}
+	if err := f.ReportResult(context.Background(), models.Result{JobID: "job-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Se detiene antes del resultado de job-2: al arrancar se lee de nuevo
+	f = fx.open("agent-1")
+	if ids := pollIDs(t, f); len(ids) != 2 {
+		t.Fatalf("after restart got %v, want the bundle again", ids)
+	}
+	for _, id := range []string{"job-1", "job-2"} {
+		if err := f.ReportResult(context.Background(), models.Result{JobID: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f = fx.open("agent-1")
+	if ids := pollIDs(t, f); len(ids) != 0 {
+		t.Fatalf("completed bundle delivered again after restart: %v", ids)
+	}
+}
+
+func TestFileDropIgnoresInvalidBundles(t *testing.T) {
+	fx := newFileDropFixture(t)
+	_, other, _ := ed25519.GenerateKey(nil)
+
+	fx.drop("forged.json", serverPayload{ID: "b1", AgentID: "agent-1", Commands: []models.Command{{ID: "forged"}}}, other)
+	fx.drop("expired.json", serverPayload{ID: "b2", AgentID: "agent-1", ExpiresAt: time.Now().Add(-time.Minute),
+		Commands: []models.Command{{ID: "expired"}}}, fx.server)
+	fx.drop("other.json", serverPayload{ID: "b3", AgentID: "agent-2", Commands: []models.Command{{ID: "other"}}}, fx.server)
+	fx.drop("good.json", serverPayload{ID: "b4", AgentID: "agent-1", Commands: []models.Command{{ID: "good"}}}, fx.server)
+
+	if ids := pollIDs(t, fx.open("agent-1")); len(ids) != 1 || ids[0] != "good" {
+		t.Fatalf("got %v, want only the valid bundle", ids)
+	}
+}
+
+func TestFileDropResultIsSigned(t *testing.T) {
+	fx := newFileDropFixture(t)
+	f := fx.open("agent-1")
+	if err := f.ReportResult(context.Background(), models.Result{JobID: "job-1"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(fx.opts.Outbox)
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("outbox has %d files (%v), want 1", len(entries), err)
+	}
+	if name := entries[0].Name(); !strings.HasPrefix(name, "result-agent-1-") || !strings.HasSuffix(name, ".json") {
+		t.Errorf("unexpected outbox file %s", name)
+	}
+	data, err := os.ReadFile(filepath.Join(fx.opts.Outbox, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b Bundle
+	if err := json.Unmarshal(data, &b); err != nil {
+		t.Fatal(err)
+	}
+	payload, _ := base64.StdEncoding.DecodeString(b.Payload)
+	want := signature(signingKey("token"), []string{"result", "agent-1", b.CreatedAt}, payload)
+	if b.Signature != want {
+		t.Errorf("signature = %s, want %s", b.Signature, want)
+	}
+}
+
+func TestFileDropRegister(t *testing.T) {
+	fx := newFileDropFixture(t)
+	f := fx.open("")
+
+	go func() {
+		// El servidor lee la solicitud del outbox y responde con su nonce
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			matches, _ := filepath.Glob(filepath.Join(fx.opts.Outbox, "register-unregistered-*.json"))
+			if len(matches) == 1 {
+				data, _ := os.ReadFile(matches[0])
+				var b Bundle
+				json.Unmarshal(data, &b)
+				payload, _ := base64.StdEncoding.DecodeString(b.Payload)
+				var req struct {
+					Nonce string `json:"nonce"`
+				}
+				json.Unmarshal(payload, &req)
+				fx.drop("register.json", serverPayload{
+					ID:       "r1",
+					Nonce:    req.Nonce,
+					Register: &RegisterResponse{ID: "agent-1", Token: "token-1"},
+				}, fx.server)
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := f.Register(ctx, RegisterRequest{TenantID: "tenant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != "agent-1" || resp.Token != "token-1" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestFileDropRegisterCanceled(t *testing.T) {
+	fx := newFileDropFixture(t)
+	f := fx.open("")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := f.Register(ctx, RegisterRequest{}); err != context.DeadlineExceeded {
+		t.Fatalf("err = %v, want the context error", err)
+	}
+}
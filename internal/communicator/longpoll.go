@@ -0,0 +1,142 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// LongPollHeader es el header con el que el servidor confirma que mantuvo
+// la petición abierta; si no viene, el servidor no soporta long-poll
+const LongPollHeader = "X-Long-Poll"
+
+// ErrLongPollUnsupported indica que el servidor ignoró el parámetro wait
+var ErrLongPollUnsupported = errors.New("server does not support long-poll")
+
+const (
+	longPollMinBackoff = 2 * time.Second
+	longPollMaxBackoff = 2 * time.Minute
+	// margen sobre wait para que el cliente no corte antes que el servidor
+	longPollGrace = 15 * time.Second
+)
+
+// LongPoller pide comandos pendientes con GET /commands/pending/{id}?wait=N;
+// el servidor retiene la petición hasta que haya comandos o venza wait
+type LongPoller struct {
+	c        *Communicator
+	wait     time.Duration
+	active   atomic.Bool
+	lastPoll atomic.Int64
+}
+
+func (c *Communicator) NewLongPoll(wait time.Duration) *LongPoller {
+	return &LongPoller{c: c, wait: wait}
+}
+
+// Active indica si el long-poll está funcionando en este momento
+func (l *LongPoller) Active() bool {
+	return l.active.Load()
+}
+
+// LastPoll retorna la hora de la última respuesta exitosa
+func (l *LongPoller) LastPoll() time.Time {
+	if ns := l.lastPoll.Load(); ns != 0 {
+		return time.Unix(0, ns)
+	}
+	return time.Time{}
+}
+
+// Run hace long-poll en bucle y entrega los comandos en out. Retorna
+// ErrLongPollUnsupported si el servidor no lo soporta, un *ProtocolError si
+// rechaza la versión del agente, o nil al cancelar ctx.
+func (l *LongPoller) Run(ctx context.Context, out chan<- models.Command) error {
+	defer l.active.Store(false)
+
+	bo := newBackoff(longPollMinBackoff, longPollMaxBackoff)
+	for {
+		commands, err := l.c.PollCommandsWait(ctx, l.wait)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if errors.Is(err, ErrLongPollUnsupported) {
+			// La respuesta fue un poll normal; no perder lo que trajo
+			for _, cmd := range commands {
+				select {
+				case out <- cmd:
+				case <-ctx.Done():
+					return nil
+				}
+			}
+			return err
+		}
+		var protoErr *ProtocolError
+		if errors.As(err, &protoErr) {
+			return err
+		}
+		if err != nil {
+			l.active.Store(false)
+			wait := bo.next()
+			var retryErr *RetryAfterError
+			if errors.As(err, &retryErr) && retryErr.RetryAfter > wait {
+				wait = retryErr.RetryAfter
+			}
+			log.Printf("Long-poll error: %v — retrying in %s", err, wait.Round(time.Second))
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(wait):
+			}
+			continue
+		}
+
+		bo.reset()
+		l.active.Store(true)
+		l.lastPoll.Store(time.Now().UnixNano())
+
+		for _, cmd := range commands {
+			select {
+			case out <- cmd:
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	}
+}
+
+// PollCommandsWait es la variante long-poll de PollCommands
+func (c *Communicator) PollCommandsWait(ctx context.Context, wait time.Duration) ([]models.Command, error) {
+	var commands []models.Command
+
+	agentID, _ := c.credentials()
+
+	resp, err := c.do(ctx, wait+longPollGrace, resty.MethodGet, fmt.Sprintf("/commands/pending/%s", agentID),
+		func(r *resty.Request) {
+			r.SetQueryParam("wait", strconv.Itoa(int(wait.Seconds()))).
+				SetResult(&commands)
+		})
+
+	if err != nil {
+		return nil, fmt.Errorf("error in long-poll: %w", err)
+	}
+
+	if resp.StatusCode() != 200 {
+		return nil, fmt.Errorf("server responded %d", resp.StatusCode())
+	}
+
+	if err := c.verifyResponse(resp); err != nil {
+		return nil, err
+	}
+
+	if resp.Header().Get(LongPollHeader) == "" {
+		return commands, ErrLongPollUnsupported
+	}
+
+	return commands, nil
+}
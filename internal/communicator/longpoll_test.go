@@ -0,0 +1,37 @@
+package communicator
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+func TestLongPollFallbackStopsWithUnreadCommands(t *testing.T) {
+	// Sin X-Long-Poll: un servidor que no soporta long-poll
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`[{"id":"job-1"}]`))
+	}))
+	defer srv.Close()
+	c := New([]string{srv.URL}, "token", "agent-1")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	out := make(chan models.Command) // nadie lo lee
+	done := make(chan error, 1)
+	go func() { done <- c.NewLongPoll(time.Second).Run(ctx, out) }()
+
+	time.Sleep(200 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run returned %v after cancel, want nil", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run blocked sending to an unread channel after cancel")
+	}
+}
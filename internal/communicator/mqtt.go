@@ -0,0 +1,459 @@
+package communicator
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/sentineledge/agent/internal/network"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+const (
+	// DefaultMQTTTopicPrefix es la raíz de todos los topics del agente
+	DefaultMQTTTopicPrefix = "sentineledge"
+
+	mqttQoS            = 1
+	mqttConnectTimeout = 30 * time.Second
+	mqttPublishTimeout = 15 * time.Second
+	mqttRegisterWait   = 30 * time.Second
+	// Un artefacto viaja en un solo mensaje; los brokers suelen limitar el
+	// tamaño, así que se rechazan los grandes antes de intentarlo
+	mqttMaxArtifact = 8 << 20
+)
+
+// MQTTOptions configura el backend MQTT
+type MQTTOptions struct {
+	Broker      string // tcp://host:1883, ssl://host:8883 o ws(s)://host/mqtt
+	Username    string // vacío: AgentID y token como credenciales del broker
+	Password    string
+	TopicPrefix string
+	TenantID    string
+}
+
+// MQTT es un Transport sobre un broker MQTT, para sitios que no pueden
+// salir por HTTPS a la API. Los comandos llegan por un topic propio del
+// agente y todo lo demás se publica en topics del tenant que terminan en
+// el AgentID, así el broker puede limitar a cada agente a los suyos:
+//
+//	<prefix>/<tenant>/agents/<id>/commands    comandos (suscripción)
+//	<prefix>/<tenant>/agents/<id>/directives  directivas del heartbeat
+//	<prefix>/<tenant>/results/<id>            resultados
+//	<prefix>/<tenant>/progress/<id>           progreso de jobs
+//	<prefix>/<tenant>/heartbeat/<id>          heartbeats
+//	<prefix>/<tenant>/inventory/<id>          inventario
+//	<prefix>/<tenant>/artifacts/<id>          artefactos
+//
+// Todo va con QoS 1 y sesión persistente (CleanSession=false): los
+// comandos publicados mientras el agente está desconectado se entregan al
+// reconectar. Cualquiera que pueda publicar en el topic de comandos podría
+// ejecutar lo que quiera, así que los comandos vienen en el mismo sobre
+// firmado que los del canal push, con el topic en lugar del path, y sin
+// firma válida se descartan.
+type MQTT struct {
+	serverSignatures
+
+	opts     MQTTOptions
+	incoming chan models.Command
+
+	mu         sync.Mutex
+	client     mqtt.Client
+	agentID    string
+	token      string
+	directives *models.HeartbeatResponse
+}
+
+var (
+	_ Transport     = (*MQTT)(nil)
+	_ Pusher        = (*MQTT)(nil)
+	_ RequestSigner = (*MQTT)(nil)
+)
+
+func NewMQTT(opts MQTTOptions, token, agentID string) *MQTT {
+	if opts.TopicPrefix == "" {
+		opts.TopicPrefix = DefaultMQTTTopicPrefix
+	}
+	return &MQTT{
+		opts:     opts,
+		incoming: make(chan models.Command, 64),
+		agentID:  agentID,
+		token:    token,
+	}
+}
+
+func (m *MQTT) tenantTopic(kind, agentID string) string {
+	return fmt.Sprintf("%s/%s/%s/%s", m.opts.TopicPrefix, m.opts.TenantID, kind, agentID)
+}
+
+func (m *MQTT) agentTopic(agentID, kind string) string {
+	return fmt.Sprintf("%s/%s/agents/%s/%s", m.opts.TopicPrefix, m.opts.TenantID, agentID, kind)
+}
+
+// clientOptions arma la conexión; username y password son las credenciales
+// del broker para este cliente
+func (m *MQTT) clientOptions(clientID, username, password string) *mqtt.ClientOptions {
+	tlsConfig := network.PinnedTLSConfig()
+	return mqtt.NewClientOptions().
+		AddBroker(m.opts.Broker).
+		SetClientID(clientID).
+		SetUsername(username).
+		SetPassword(password).
+		SetTLSConfig(tlsConfig).
+		SetConnectTimeout(mqttConnectTimeout).
+		SetKeepAlive(60 * time.Second).
+		SetOrderMatters(true)
+}
+
+// connect retorna el cliente conectado, creándolo la primera vez. La
+// librería reconecta sola; mientras tanto las llamadas fallan con
+// ErrNetwork.
+func (m *MQTT) connect() (mqtt.Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.client == nil {
+		if m.agentID == "" {
+			return nil, &NetworkError{Err: errors.New("agent is not registered")}
+		}
+		username, password := m.opts.Username, m.opts.Password
+		if username == "" {
+			username, password = m.agentID, m.token
+		}
+		agentID := m.agentID
+		opts := m.clientOptions("se-agent-"+agentID, username, password).
+			SetCleanSession(false).
+			SetAutoAckDisabled(true).
+			SetAutoReconnect(true).
+			SetConnectRetry(true).
+			SetOnConnectHandler(func(c mqtt.Client) {
+				// Con sesión persistente el broker recuerda la suscripción,
+				// pero si la sesión expiró hay que volver a crearla
+				m.subscribe(c, agentID)
+			}).
+			SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+				log.Printf("MQTT connection lost: %v", err)
+			})
+		m.client = mqtt.NewClient(opts)
+		// Con ConnectRetry el token solo se completa al conectar; los
+		// reintentos siguen en segundo plano
+		m.client.Connect().WaitTimeout(mqttConnectTimeout)
+	}
+
+	if !m.client.IsConnectionOpen() {
+		return nil, &NetworkError{Err: fmt.Errorf("not connected to MQTT broker %s", m.opts.Broker)}
+	}
+	return m.client, nil
+}
+
+func (m *MQTT) subscribe(c mqtt.Client, agentID string) {
+	topics := map[string]byte{
+		m.agentTopic(agentID, "commands"):   mqttQoS,
+		m.agentTopic(agentID, "directives"): mqttQoS,
+	}
+	t := c.SubscribeMultiple(topics, m.handleMessage)
+	if !t.WaitTimeout(mqttPublishTimeout) || t.Error() != nil {
+		log.Printf("MQTT subscribe error: %v", t.Error())
+		return
+	}
+	log.Printf("MQTT connected to %s", m.opts.Broker)
+}
+
+// handleMessage recibe comandos y directivas. Corre en la goroutine que
+// lee de la conexión (OrderMatters), así que no puede bloquearse: si la
+// cola de comandos está llena el mensaje queda sin ack y el broker lo
+// vuelve a entregar al reconectar, por la sesión persistente. Los jobs
+// repetidos se descartan en el agente.
+func (m *MQTT) handleMessage(_ mqtt.Client, msg mqtt.Message) {
+	switch {
+	case strings.HasSuffix(msg.Topic(), "/commands"):
+		cmd, err := m.command(msg)
+		if err != nil {
+			log.Printf("Ignoring MQTT command on %s: %v", msg.Topic(), err)
+			msg.Ack()
+			return
+		}
+		select {
+		case m.incoming <- cmd:
+			msg.Ack()
+		default:
+			log.Printf("MQTT command queue full — leaving job %s unacknowledged for redelivery", cmd.ID)
+		}
+	case strings.HasSuffix(msg.Topic(), "/directives"):
+		var d models.HeartbeatResponse
+		if err := json.Unmarshal(msg.Payload(), &d); err != nil {
+			log.Printf("Ignoring invalid MQTT directives: %v", err)
+		} else {
+			m.mu.Lock()
+			m.directives = &d
+			m.mu.Unlock()
+		}
+		msg.Ack()
+	default:
+		msg.Ack()
+	}
+}
+
+// command verifica la firma de un comando recibido y lo decodifica. A
+// diferencia de las respuestas HTTP, un comando sin firma nunca se acepta:
+// no hay servidores MQTT anteriores a las firmas.
+func (m *MQTT) command(msg mqtt.Message) (models.Command, error) {
+	var env pushMessage
+	var cmd models.Command
+	if err := json.Unmarshal(msg.Payload(), &env); err != nil {
+		return cmd, fmt.Errorf("invalid message: %w", err)
+	}
+	if env.Signature == "" {
+		return cmd, fmt.Errorf("%w: command is not signed", ErrBadSignature)
+	}
+	err := m.verifySignature(env.Signature, env.Timestamp,
+		[]string{"command", msg.Topic(), env.Timestamp}, env.Command, nil)
+	if err != nil {
+		return cmd, err
+	}
+	if err := json.Unmarshal(env.Command, &cmd); err != nil || cmd.ID == "" {
+		return cmd, fmt.Errorf("invalid command: %v", err)
+	}
+	return cmd, nil
+}
+
+// waitToken espera a que el broker confirme la operación, como máximo
+// timeout o hasta que se cancele ctx
+func waitToken(ctx context.Context, t mqtt.Token, timeout time.Duration, what string) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.Done():
+		if err := t.Error(); err != nil {
+			return &NetworkError{Err: fmt.Errorf("MQTT %s: %w", what, err)}
+		}
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return &NetworkError{Err: fmt.Errorf("timeout on MQTT %s", what)}
+	}
+}
+
+func (m *MQTT) publish(ctx context.Context, kind string, v any) error {
+	client, err := m.connect()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	agentID, _ := m.credentials()
+
+	t := client.Publish(m.tenantTopic(kind, agentID), mqttQoS, false, payload)
+	return waitToken(ctx, t, mqttPublishTimeout, "publish "+kind)
+}
+
+func (m *MQTT) credentials() (agentID, token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.agentID, m.token
+}
+
+// Register publica la solicitud en <prefix>/<tenant>/register y espera la
+// respuesta en un topic de un solo uso indicado en reply_to. Usa una
+// conexión aparte, autenticada con TenantID y APIKey si no hay
+// credenciales de broker configuradas.
+func (m *MQTT) Register(ctx context.Context, req RegisterRequest) (*RegisterResponse, error) {
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	id := hex.EncodeToString(nonce)
+	replyTo := fmt.Sprintf("%s/%s/register/%s", m.opts.TopicPrefix, m.opts.TenantID, id)
+
+	username, password := m.opts.Username, m.opts.Password
+	if username == "" {
+		username, password = req.TenantID, req.APIKey
+	}
+	client := mqtt.NewClient(m.clientOptions("se-register-"+id, username, password).SetCleanSession(true))
+	if err := waitToken(ctx, client.Connect(), mqttConnectTimeout, "connect"); err != nil {
+		return nil, fmt.Errorf("Error registering agent: %w", err)
+	}
+	defer client.Disconnect(250)
+
+	replies := make(chan []byte, 1)
+	sub := client.Subscribe(replyTo, mqttQoS, func(_ mqtt.Client, msg mqtt.Message) {
+		select {
+		case replies <- msg.Payload():
+		default:
+		}
+	})
+	if err := waitToken(ctx, sub, mqttPublishTimeout, "subscribe"); err != nil {
+		return nil, fmt.Errorf("Error registering agent: %w", err)
+	}
+
+	payload, err := json.Marshal(struct {
+		RegisterRequest
+		ReplyTo string `json:"reply_to"`
+	}{req, replyTo})
+	if err != nil {
+		return nil, err
+	}
+	pub := client.Publish(fmt.Sprintf("%s/%s/register", m.opts.TopicPrefix, m.opts.TenantID), mqttQoS, false, payload)
+	if err := waitToken(ctx, pub, mqttPublishTimeout, "publish register"); err != nil {
+		return nil, fmt.Errorf("Error registering agent: %w", err)
+	}
+
+	select {
+	case raw := <-replies:
+		var resp RegisterResponse
+		if err := json.Unmarshal(raw, &resp); err != nil {
+			return nil, fmt.Errorf("Error registering agent: %w", &DecodeError{Err: err})
+		}
+		if resp.ID == "" || resp.Token == "" {
+			return nil, fmt.Errorf("Server rejected registration: %s", resp.Message)
+		}
+		log.Printf("Agent successfully registered. ID: %s", resp.ID)
+		return &resp, nil
+	case <-time.After(mqttRegisterWait):
+		return nil, fmt.Errorf("Error registering agent: %w", &NetworkError{Err: errors.New("no registration response over MQTT")})
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// PollCommands retorna los comandos que llegaron por la suscripción y no
+// se entregaron todavía; por MQTT no hay nada que pedir
+func (m *MQTT) PollCommands(ctx context.Context) (*PollResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := m.connect(); err != nil {
+		return nil, err
+	}
+	var cmds []models.Command
+	for {
+		select {
+		case cmd := <-m.incoming:
+			cmds = append(cmds, cmd)
+		default:
+			return &PollResponse{Commands: cmds}, nil
+		}
+	}
+}
+
+func (m *MQTT) ReportResult(ctx context.Context, result models.Result) error {
+	if err := m.publish(ctx, "results", result); err != nil {
+		return fmt.Errorf("error reporting result: %w", err)
+	}
+	log.Printf("Job %s result reported successfully", result.JobID)
+	return nil
+}
+
+func (m *MQTT) ReportProgress(ctx context.Context, p models.Progress) error {
+	if err := m.publish(ctx, "progress", p); err != nil {
+		return fmt.Errorf("error reporting progress: %w", err)
+	}
+	return nil
+}
+
+// Heartbeat publica el estado y retorna las últimas directivas recibidas
+// en el topic directives, una sola vez cada una
+func (m *MQTT) Heartbeat(ctx context.Context, hb models.Heartbeat) (*models.HeartbeatResponse, error) {
+	if err := m.publish(ctx, "heartbeat", hb); err != nil {
+		return nil, fmt.Errorf("error sending heartbeat: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	d := m.directives
+	m.directives = nil
+	if d == nil {
+		d = &models.HeartbeatResponse{}
+	}
+	return d, nil
+}
+
+func (m *MQTT) SendInventory(ctx context.Context, inv *models.Inventory) error {
+	if err := m.publish(ctx, "inventory", inv); err != nil {
+		return fmt.Errorf("error sending inventory: %w", err)
+	}
+	log.Printf("Inventory sent successfully — %d software items, %d disks, %d NICs",
+		len(inv.Software), len(inv.Disks), len(inv.NICs))
+	return nil
+}
+
+// UploadArtifact publica el archivo entero en base64 en un solo mensaje
+func (m *MQTT) UploadArtifact(ctx context.Context, jobID, name string, r io.Reader) error {
+	data, err := io.ReadAll(io.LimitReader(r, mqttMaxArtifact+1))
+	if err != nil {
+		return fmt.Errorf("could not read artifact %s: %w", name, err)
+	}
+	if len(data) > mqttMaxArtifact {
+		return fmt.Errorf("artifact %s exceeds the %d MiB MQTT limit", name, mqttMaxArtifact>>20)
+	}
+	err = m.publish(ctx, "artifacts", map[string]string{
+		"job_id": jobID,
+		"name":   name,
+		"data":   base64.StdEncoding.EncodeToString(data),
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading artifact %s: %w", name, err)
+	}
+	return nil
+}
+
+// SetCredentials cambia ID y token. Si cambió el ID la conexión se cierra
+// para abrir la próxima con el client ID y los topics nuevos.
+func (m *MQTT) SetCredentials(agentID, token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	changed := agentID != m.agentID || (m.opts.Username == "" && token != m.token)
+	m.agentID = agentID
+	m.token = token
+	if changed && m.client != nil {
+		m.client.Disconnect(250)
+		m.client = nil
+	}
+}
+
+func (m *MQTT) ActiveEndpoint() string {
+	return m.opts.Broker
+}
+
+// NewPush entrega los comandos de la suscripción apenas llegan
+func (m *MQTT) NewPush() CommandStream {
+	return &mqttStream{m: m}
+}
+
+type mqttStream struct {
+	m *MQTT
+}
+
+func (s *mqttStream) Run(ctx context.Context, out chan<- models.Command) {
+	// Conectar ya, sin esperar al primer poll o heartbeat
+	if _, err := s.m.connect(); err != nil {
+		log.Printf("MQTT: %v — retrying in background", err)
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case cmd := <-s.m.incoming:
+			select {
+			case out <- cmd:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+func (s *mqttStream) Connected() bool {
+	s.m.mu.Lock()
+	defer s.m.mu.Unlock()
+	return s.m.client != nil && s.m.client.IsConnectionOpen()
+}
@@ -0,0 +1,428 @@
+package communicator
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// testBroker es un broker MQTT 3.1.1 mínimo para los tests: QoS 0 y 1,
+// topics exactos sin comodines y sesiones persistentes que reenvían lo
+// que quedó sin ack al reconectar
+type testBroker struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu        sync.Mutex
+	sessions  map[string]*brokerSession
+	published chan *packets.PublishPacket // todo lo que publican los clientes
+}
+
+type brokerSession struct {
+	subs     map[string]bool
+	conn     *brokerConn
+	inflight map[uint16]*packets.PublishPacket
+	nextID   uint16
+}
+
+type brokerConn struct {
+	net.Conn
+	wmu sync.Mutex
+}
+
+func (c *brokerConn) send(p packets.ControlPacket) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	p.Write(c.Conn)
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{
+		t:         t,
+		ln:        ln,
+		sessions:  make(map[string]*brokerSession),
+		published: make(chan *packets.PublishPacket, 100),
+	}
+	go b.serve()
+	t.Cleanup(func() {
+		ln.Close()
+		b.mu.Lock()
+		for _, s := range b.sessions {
+			if s.conn != nil {
+				s.conn.Close()
+			}
+		}
+		b.mu.Unlock()
+	})
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *testBroker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		go b.handle(&brokerConn{Conn: conn})
+	}
+}
+
+func (b *testBroker) handle(c *brokerConn) {
+	defer c.Close()
+	p, err := packets.ReadPacket(c)
+	if err != nil {
+		return
+	}
+	connect, ok := p.(*packets.ConnectPacket)
+	if !ok {
+		return
+	}
+
+	b.mu.Lock()
+	s, present := b.sessions[connect.ClientIdentifier]
+	if !present || connect.CleanSession {
+		s = &brokerSession{subs: make(map[string]bool), inflight: make(map[uint16]*packets.PublishPacket)}
+		b.sessions[connect.ClientIdentifier] = s
+		present = false
+	}
+	s.conn = c
+	ack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+	ack.SessionPresent = present
+	c.send(ack)
+	for _, pub := range s.inflight {
+		dup := pub.Copy()
+		dup.Qos = pub.Qos
+		dup.MessageID = pub.MessageID
+		dup.Dup = true
+		c.send(dup)
+	}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		if s.conn == c {
+			s.conn = nil
+		}
+		b.mu.Unlock()
+	}()
+
+	for {
+		p, err := packets.ReadPacket(c)
+		if err != nil {
+			return
+		}
+		switch p := p.(type) {
+		case *packets.SubscribePacket:
+			b.mu.Lock()
+			for _, topic := range p.Topics {
+				s.subs[topic] = true
+			}
+			b.mu.Unlock()
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			c.send(ack)
+		case *packets.PublishPacket:
+			if p.Qos > 0 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				c.send(ack)
+			}
+			b.published <- p
+			b.publish(p.TopicName, p.Payload)
+		case *packets.PubackPacket:
+			b.mu.Lock()
+			delete(s.inflight, p.MessageID)
+			b.mu.Unlock()
+		case *packets.PingreqPacket:
+			c.send(packets.NewControlPacket(packets.Pingresp))
+		case *packets.DisconnectPacket:
+			return
+		}
+	}
+}
+
+// publish entrega payload con QoS 1 a las sesiones suscritas a topic
+func (b *testBroker) publish(topic string, payload []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, s := range b.sessions {
+		if !s.subs[topic] {
+			continue
+		}
+		s.nextID++
+		pub := packets.NewControlPacket(packets.Publish).(*packets.PublishPacket)
+		pub.TopicName = topic
+		pub.Qos = 1
+		pub.MessageID = s.nextID
+		pub.Payload = payload
+		s.inflight[pub.MessageID] = pub
+		if s.conn != nil {
+			s.conn.send(pub)
+		}
+	}
+}
+
+// waitSubscribed espera a que algún cliente se suscriba a topic
+func (b *testBroker) waitSubscribed(topic string) {
+	b.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		for _, s := range b.sessions {
+			if s.subs[topic] {
+				b.mu.Unlock()
+				return
+			}
+		}
+		b.mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.t.Fatalf("nobody subscribed to %s", topic)
+}
+
+// waitPublished espera un mensaje publicado por un cliente en topic
+func (b *testBroker) waitPublished(topic string) []byte {
+	b.t.Helper()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case p := <-b.published:
+			if p.TopicName == topic {
+				return p.Payload
+			}
+		case <-timeout:
+			b.t.Fatalf("nothing published on %s", topic)
+			return nil
+		}
+	}
+}
+
+// waitInflight espera a que clientID tenga n mensajes sin ack; los acks
+// salen de forma asíncrona
+func (b *testBroker) waitInflight(clientID string, n int) {
+	b.t.Helper()
+	var got int
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.mu.Lock()
+		got = 0
+		if s, ok := b.sessions[clientID]; ok {
+			got = len(s.inflight)
+		}
+		b.mu.Unlock()
+		if got == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	b.t.Fatalf("%d messages unacknowledged by %s, want %d", got, clientID, n)
+}
+
+// drop corta la conexión de clientID, como una caída de red
+func (b *testBroker) drop(clientID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if s, ok := b.sessions[clientID]; ok && s.conn != nil {
+		s.conn.Close()
+	}
+}
+
+func newTestMQTT(t *testing.T, b *testBroker) *MQTT {
+	t.Helper()
+	m := NewMQTT(MQTTOptions{Broker: b.url(), TenantID: "tenant"}, "token", "agent-1")
+	m.SetSigningSecret("secret")
+	t.Cleanup(func() { m.SetCredentials("", "") })
+	return m
+}
+
+const commandsTopic = "sentineledge/tenant/agents/agent-1/commands"
+
+// commandPayload arma el sobre de un comando firmado con secret; vacío
+// lo deja sin firma
+func commandPayload(t *testing.T, id, secret string) []byte {
+	t.Helper()
+	cmd, err := json.Marshal(models.Command{ID: id, Type: "bash", Payload: "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := pushMessage{Type: "command", ID: id, Command: cmd}
+	if secret != "" {
+		env.Timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+		env.Signature = signature(signingKey(secret), []string{"command", commandsTopic, env.Timestamp}, cmd)
+	}
+	data, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// pollUntil hace poll hasta recibir n comandos
+func pollUntil(t *testing.T, m *MQTT, n int) []models.Command {
+	t.Helper()
+	var cmds []models.Command
+	deadline := time.Now().Add(5 * time.Second)
+	for len(cmds) < n && time.Now().Before(deadline) {
+		resp, err := m.PollCommands(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, resp.Commands...)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(cmds) < n {
+		t.Fatalf("got %d commands, want %d", len(cmds), n)
+	}
+	return cmds
+}
+
+func TestMQTTRegister(t *testing.T) {
+	b := newTestBroker(t)
+	m := NewMQTT(MQTTOptions{Broker: b.url(), TenantID: "tenant"}, "", "")
+
+	go func() {
+		var req struct {
+			RegisterRequest
+			ReplyTo string `json:"reply_to"`
+		}
+		if err := json.Unmarshal(b.waitPublished("sentineledge/tenant/register"), &req); err != nil {
+			t.Errorf("register request: %v", err)
+			return
+		}
+		if req.Hostname != "host-1" || !strings.HasPrefix(req.ReplyTo, "sentineledge/tenant/register/") {
+			t.Errorf("unexpected register request %+v", req)
+		}
+		resp, _ := json.Marshal(RegisterResponse{ID: "agent-1", Token: "token-1"})
+		b.publish(req.ReplyTo, resp)
+	}()
+
+	resp, err := m.Register(context.Background(), RegisterRequest{Hostname: "host-1", TenantID: "tenant"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ID != "agent-1" || resp.Token != "token-1" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestMQTTCommandsAndResults(t *testing.T) {
+	b := newTestBroker(t)
+	m := newTestMQTT(t, b)
+
+	if _, err := m.PollCommands(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b.waitSubscribed(commandsTopic)
+	b.publish(commandsTopic, commandPayload(t, "job-1", "secret"))
+
+	if cmds := pollUntil(t, m, 1); cmds[0].ID != "job-1" {
+		t.Fatalf("got command %s, want job-1", cmds[0].ID)
+	}
+
+	if err := m.ReportResult(context.Background(), models.Result{JobID: "job-1", ExitCode: 0}); err != nil {
+		t.Fatal(err)
+	}
+	var result models.Result
+	if err := json.Unmarshal(b.waitPublished("sentineledge/tenant/results/agent-1"), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.JobID != "job-1" {
+		t.Errorf("published result for %s, want job-1", result.JobID)
+	}
+}
+
+func TestMQTTIgnoresUnsignedCommands(t *testing.T) {
+	b := newTestBroker(t)
+	m := newTestMQTT(t, b)
+
+	if _, err := m.PollCommands(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b.waitSubscribed(commandsTopic)
+	b.publish(commandsTopic, commandPayload(t, "unsigned", ""))
+	b.publish(commandsTopic, commandPayload(t, "forged", "other-secret"))
+	b.publish(commandsTopic, commandPayload(t, "job-1", "secret"))
+
+	// Los mensajes se procesan en orden: cuando llega el firmado los
+	// anteriores ya se descartaron
+	cmds := pollUntil(t, m, 1)
+	if len(cmds) != 1 || cmds[0].ID != "job-1" {
+		t.Fatalf("got %v, want only the signed job-1", cmds)
+	}
+	b.waitInflight("se-agent-agent-1", 0)
+}
+
+func TestMQTTFullQueueDoesNotBlockConnection(t *testing.T) {
+	b := newTestBroker(t)
+	m := newTestMQTT(t, b)
+	m.incoming = make(chan models.Command, 1)
+
+	if _, err := m.PollCommands(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b.waitSubscribed(commandsTopic)
+	b.publish(commandsTopic, commandPayload(t, "job-1", "secret"))
+	b.publish(commandsTopic, commandPayload(t, "job-2", "secret"))
+
+	// Si el handler se bloqueara con la cola llena, el PUBACK del
+	// heartbeat no se procesaría y el publish vencería
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := m.Heartbeat(ctx, models.Heartbeat{}); err != nil {
+		t.Fatalf("heartbeat with a full command queue: %v", err)
+	}
+	b.waitInflight("se-agent-agent-1", 1)
+
+	// El que no entró se entrega de nuevo al reconectar
+	if cmds := pollUntil(t, m, 1); cmds[0].ID != "job-1" {
+		t.Fatalf("got command %s, want job-1", cmds[0].ID)
+	}
+	b.drop("se-agent-agent-1")
+	if cmds := pollUntil(t, m, 1); cmds[0].ID != "job-2" {
+		t.Fatalf("got command %s after reconnecting, want job-2", cmds[0].ID)
+	}
+	b.waitInflight("se-agent-agent-1", 0)
+}
+
+func TestMQTTDirectives(t *testing.T) {
+	b := newTestBroker(t)
+	m := newTestMQTT(t, b)
+
+	if _, err := m.PollCommands(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	b.waitSubscribed("sentineledge/tenant/agents/agent-1/directives")
+	d, _ := json.Marshal(models.HeartbeatResponse{CollectInventory: true})
+	b.publish("sentineledge/tenant/agents/agent-1/directives", d)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		resp, err := m.Heartbeat(context.Background(), models.Heartbeat{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.CollectInventory {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("directives were not returned by Heartbeat")
+}
@@ -0,0 +1,43 @@
+package communicator
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sentineledge/agent/internal/version"
+)
+
+// MinProtocolHeader es el header con el que el servidor anuncia la versión
+// mínima de protocolo que acepta
+const MinProtocolHeader = "X-Min-Protocol"
+
+// ProtocolError indica que el servidor exige un protocolo más nuevo que el
+// de este agente; hay que actualizar el binario
+type ProtocolError struct {
+	Required  int
+	Supported int
+}
+
+func (e *ProtocolError) Error() string {
+	if e.Required > 0 {
+		return fmt.Sprintf("server requires agent protocol %d or newer, this agent (version %s) speaks protocol %d — update the agent",
+			e.Required, version.Version, e.Supported)
+	}
+	return fmt.Sprintf("server rejected agent protocol %d (version %s) — update the agent", e.Supported, version.Version)
+}
+
+// checkProtocol detecta un 426 Upgrade Required o un X-Min-Protocol mayor
+// que el soportado
+func checkProtocol(resp *resty.Response) error {
+	return protocolError(resp.StatusCode(), resp.Header())
+}
+
+func protocolError(code int, header http.Header) error {
+	required, _ := strconv.Atoi(header.Get(MinProtocolHeader))
+	if code == http.StatusUpgradeRequired || required > version.ProtocolVersion {
+		return &ProtocolError{Required: required, Supported: version.ProtocolVersion}
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package communicator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sentineledge/agent/internal/network"
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+const (
+	pushMinBackoff = time.Second
+	pushMaxBackoff = 5 * time.Minute
+	pushPongWait   = 90 * time.Second
+	pushPingPeriod = 30 * time.Second
+	pushWriteWait  = 10 * time.Second
+)
+
+// pushMessage es lo que viaja por el WebSocket en ambos sentidos. Los
+// comandos vienen firmados como las respuestas HTTP: la firma cubre
+// "command", el path del WebSocket, el timestamp y el JSON del comando tal
+// como llegó. Por MQTT los comandos vienen en el mismo sobre, con el topic
+// en lugar del path.
+type pushMessage struct {
+	Type      string          `json:"type"` // "command" del servidor, "ack" del agente
+	ID        string          `json:"id,omitempty"`
+	Command   json.RawMessage `json:"command,omitempty"`
+	Timestamp string          `json:"timestamp,omitempty"`
+	Signature string          `json:"signature,omitempty"`
+}
+
+// PushClient mantiene un WebSocket con el servidor por el que llegan los
+// comandos apenas se encolan
+type PushClient struct {
+	c         *Communicator
+	dialer    *websocket.Dialer
+	connected atomic.Bool
+}
+
+// NewPush prepara el canal push hacia /agents/{id}/ws
+func (c *Communicator) NewPush() CommandStream {
+	return &PushClient{
+		c: c,
+		dialer: &websocket.Dialer{
+			Proxy:            network.Proxy(),
+			TLSClientConfig:  c.tlsConfig,
+			HandshakeTimeout: 15 * time.Second,
+		},
+	}
+}
+
+// Connected indica si el WebSocket está establecido en este momento
+func (p *PushClient) Connected() bool {
+	return p.connected.Load()
+}
+
+// Run conecta y entrega en out los comandos recibidos. Si la conexión cae
+// reconecta con backoff exponencial hasta que ctx se cancele.
+func (p *PushClient) Run(ctx context.Context, out chan<- models.Command) {
+	bo := newBackoff(pushMinBackoff, pushMaxBackoff)
+	for {
+		start := time.Now()
+		err := p.session(ctx, out)
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Push channel closed: %v", err)
+
+		// Si la sesión duró, el problema no es persistente
+		if time.Since(start) > pushMaxBackoff {
+			bo.reset()
+		}
+		wait := bo.next()
+		log.Printf("Reconnecting push channel in %s", wait.Round(time.Second))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// url y header se arman en cada conexión con el endpoint y token vigentes
+func (p *PushClient) url() string {
+	return p.base() + p.path()
+}
+
+func (p *PushClient) base() string {
+	wsURL := p.c.endpoints.Active()
+	switch {
+	case strings.HasPrefix(wsURL, "https://"):
+		wsURL = "wss://" + strings.TrimPrefix(wsURL, "https://")
+	case strings.HasPrefix(wsURL, "http://"):
+		wsURL = "ws://" + strings.TrimPrefix(wsURL, "http://")
+	}
+	return wsURL
+}
+
+func (p *PushClient) path() string {
+	agentID, _ := p.c.credentials()
+	return fmt.Sprintf("/agents/%s/ws", agentID)
+}
+
+func (p *PushClient) header() http.Header {
+	header := http.Header{}
+	if _, token := p.c.credentials(); token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+	return header
+}
+
+func (p *PushClient) session(ctx context.Context, out chan<- models.Command) error {
+	conn, resp, err := p.dialer.DialContext(ctx, p.url(), p.header())
+	if err != nil {
+		if resp != nil {
+			return fmt.Errorf("dial failed: %w", &StatusError{StatusCode: resp.StatusCode})
+		}
+		return fmt.Errorf("dial failed: %w", &NetworkError{Err: err})
+	}
+	defer conn.Close()
+
+	log.Println("Push channel connected")
+	p.connected.Store(true)
+	defer p.connected.Store(false)
+
+	conn.SetReadDeadline(time.Now().Add(pushPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pushPongWait))
+	})
+
+	// Los pings y el cierre corren aparte; gorilla permite un solo escritor
+	// a la vez, así que acks y pings comparten writes
+	writes := make(chan pushMessage, 16)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		ticker := time.NewTicker(pushPingPeriod)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+					time.Now().Add(pushWriteWait))
+				conn.Close()
+				return
+			case msg := <-writes:
+				conn.SetWriteDeadline(time.Now().Add(pushWriteWait))
+				if err := conn.WriteJSON(msg); err != nil {
+					conn.Close()
+					return
+				}
+			case <-ticker.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pushWriteWait)); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(pushPongWait))
+
+		var msg pushMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("Push channel: invalid message: %v", err)
+			continue
+		}
+		if msg.Type != "command" || len(msg.Command) == 0 {
+			continue
+		}
+		cmd, err := p.command(msg)
+		if err != nil {
+			// Sin ack: el servidor lo vuelve a ofrecer o queda para el poll
+			log.Printf("Push channel: command rejected: %v", err)
+			continue
+		}
+
+		select {
+		case out <- cmd:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		select {
+		case writes <- pushMessage{Type: "ack", ID: cmd.ID}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// command verifica la firma de un comando recibido y lo decodifica
+func (p *PushClient) command(msg pushMessage) (models.Command, error) {
+	var cmd models.Command
+	err := p.c.verifySignature(msg.Signature, msg.Timestamp,
+		[]string{msg.Type, p.path(), msg.Timestamp}, msg.Command, nil)
+	if err != nil {
+		return cmd, err
+	}
+	if err := json.Unmarshal(msg.Command, &cmd); err != nil {
+		return cmd, fmt.Errorf("invalid command: %w", err)
+	}
+	return cmd, nil
+}
@@ -0,0 +1,63 @@
+package communicator
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NextPollHeader es el header con el que el servidor sugiere, en segundos,
+// cuándo volver a preguntar por comandos
+const NextPollHeader = "X-Next-Poll"
+
+// MaxRetryAfter es lo máximo que se respeta de Retry-After o X-Next-Poll;
+// un valor absurdo o una fecha mal puesta no puede dejar al agente mudo
+const MaxRetryAfter = 10 * time.Minute
+
+// RetryAfterError indica que el servidor está saturado (429 o 503) y,
+// si lo envió, cuánto pidió esperar. Es ErrRateLimited para errors.Is, y
+// además ErrServer si fue un 503.
+type RetryAfterError struct {
+	StatusCode int
+	RetryAfter time.Duration
+}
+
+func (e *RetryAfterError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("server responded %d, retry after %s", e.StatusCode, e.RetryAfter)
+	}
+	return fmt.Sprintf("server responded %d", e.StatusCode)
+}
+
+func (e *RetryAfterError) Is(target error) bool {
+	return target == ErrRateLimited || (target == ErrServer && e.StatusCode >= 500)
+}
+
+// parseRetryAfter acepta segundos o una fecha HTTP, hasta MaxRetryAfter
+func parseRetryAfter(value string) time.Duration {
+	return min(parseDelay(value), MaxRetryAfter)
+}
+
+func parseDelay(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0
+		}
+		if secs > int(MaxRetryAfter/time.Second) {
+			return MaxRetryAfter // evita desbordar la multiplicación
+		}
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
@@ -0,0 +1,177 @@
+package communicator
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sentineledge/agent/internal/clock"
+)
+
+const (
+	// TimestampHeader lleva la hora Unix (segundos) en que se firmó el mensaje
+	TimestampHeader = "X-SE-Timestamp"
+	// SignatureHeader lleva la firma "v1=<hex>" del mensaje
+	SignatureHeader = "X-SE-Signature"
+
+	// signingContext separa la llave de firma del secreto del que se deriva
+	signingContext = "sentineledge-request-signing-v1"
+
+	// MaxSignatureAge es la diferencia máxima aceptada entre la hora de una
+	// firma del servidor y la hora local corregida con el desfase estimado
+	MaxSignatureAge = 5 * time.Minute
+)
+
+// ErrBadSignature indica que una respuesta firmada no pasó la verificación
+var ErrBadSignature = errors.New("response signature verification failed")
+
+// signingKey deriva la llave HMAC de un secreto que no viaja en las
+// peticiones: el de firma que emite el servidor al registrar, o el token en
+// el file drop, donde no hay header Authorization
+func signingKey(secret string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingContext))
+	return mac.Sum(nil)
+}
+
+// signature calcula la firma sobre las líneas dadas, la última es el body.
+// Para peticiones: método, path con query, timestamp, body. Para
+// respuestas: status, path de la petición, timestamp, body.
+func signature(key []byte, fields []string, body []byte) string {
+	sum := sha256.Sum256(body)
+	return signatureOfSum(key, fields, sum[:])
+}
+
+// signatureOfSum es signature con el SHA-256 del body ya calculado
+func signatureOfSum(key []byte, fields []string, bodySum []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	mac.Write([]byte("\n"))
+	mac.Write([]byte(hex.EncodeToString(bodySum)))
+	return "v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest es el pre-request hook de resty: corre sobre la petición HTTP
+// final, así la firma cubre el path real (con prefijo si lo hay) y el body
+// tal como viaja, comprimido o no. Cada reintento se firma de nuevo. El
+// body se lee de GetBody sin cargarlo entero, ej. un artefacto en disco.
+func (c *Communicator) signRequest(_ *resty.Client, req *http.Request) error {
+	secret := c.secret()
+	if secret == "" {
+		return nil
+	}
+
+	sum := sha256.New()
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return fmt.Errorf("could not read body to sign: %w", err)
+		}
+		_, err = io.Copy(sum, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("could not read body to sign: %w", err)
+		}
+	}
+
+	// Con la hora del servidor, así un reloj local corrido no invalida
+	// las firmas
+	ts := strconv.FormatInt(clock.Now().Unix(), 10)
+	req.Header.Set(TimestampHeader, ts)
+	req.Header.Set(SignatureHeader, signatureOfSum(signingKey(secret),
+		[]string{req.Method, req.URL.RequestURI(), ts}, sum.Sum(nil)))
+	return nil
+}
+
+// serverSignatures es lo necesario para verificar lo que firma el
+// servidor; lo comparten los transportes que reciben comandos por más de
+// una vía
+type serverSignatures struct {
+	// requireSigned rechaza respuestas de poll sin firma; seenSigned hace
+	// lo mismo una vez que el servidor firmó una
+	requireSigned atomic.Bool
+	seenSigned    atomic.Bool
+
+	secretMu      sync.RWMutex
+	signingSecret string
+}
+
+// SetSigningSecret cambia el secreto de firma que el servidor emitió al
+// registrar el agente. El token viaja en cada petición en Authorization,
+// por eso no sirve como llave: quien lo vea podría firmar. Sin secreto no
+// se firma y no se puede verificar ninguna respuesta firmada.
+func (s *serverSignatures) SetSigningSecret(secret string) {
+	s.secretMu.Lock()
+	defer s.secretMu.Unlock()
+	s.signingSecret = secret
+}
+
+func (s *serverSignatures) secret() string {
+	s.secretMu.RLock()
+	defer s.secretMu.RUnlock()
+	return s.signingSecret
+}
+
+// SetRequireSignedResponses hace que las respuestas sin firma de los polls
+// se rechacen desde el principio. Sin esto se exigen recién después de la
+// primera respuesta firmada válida, para seguir funcionando con servidores
+// que todavía no firman sin dejar que alguien en el medio quite la firma.
+func (s *serverSignatures) SetRequireSignedResponses(require bool) {
+	s.requireSigned.Store(require)
+}
+
+// verifyResponse comprueba la firma de una respuesta del servidor. Una
+// respuesta con firma válida también es una muestra del reloj del
+// servidor: la hora firmada no la puede cambiar nadie en el medio.
+func (c *Communicator) verifyResponse(resp *resty.Response) error {
+	ts := resp.Header().Get(TimestampHeader)
+	return c.verifySignature(resp.Header().Get(SignatureHeader), ts,
+		[]string{strconv.Itoa(resp.StatusCode()), resp.Request.RawRequest.URL.RequestURI(), ts}, resp.Body(),
+		func(signedAt time.Time) { clock.Observe(signedAt, resp.Request.Time, resp.ReceivedAt()) })
+}
+
+// verifySignature comprueba una firma del servidor sobre fields y body. Una
+// firma vacía se acepta salvo que se exijan firmas. Si la firma es válida
+// se llama a observe, si no es nil, con la hora firmada antes de decidir si
+// es reciente: así un equipo con el reloj corrido aprende el desfase de las
+// mismas respuestas que tiene que aceptar.
+func (s *serverSignatures) verifySignature(sig, ts string, fields []string, body []byte, observe func(signedAt time.Time)) error {
+	if sig == "" {
+		if s.requireSigned.Load() || s.seenSigned.Load() {
+			return fmt.Errorf("%w: response is not signed", ErrBadSignature)
+		}
+		return nil
+	}
+	secret := s.secret()
+	if secret == "" {
+		return fmt.Errorf("%w: no signing secret to verify it", ErrBadSignature)
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: invalid timestamp %q", ErrBadSignature, ts)
+	}
+	if !hmac.Equal([]byte(sig), []byte(signature(signingKey(secret), fields, body))) {
+		return fmt.Errorf("%w: signature mismatch", ErrBadSignature)
+	}
+
+	signedAt := time.Unix(unix, 0)
+	if observe != nil {
+		observe(signedAt)
+	}
+	if age := clock.Now().Sub(signedAt); age > MaxSignatureAge || age < -MaxSignatureAge {
+		return fmt.Errorf("%w: timestamp off by %s", ErrBadSignature, age.Round(time.Second))
+	}
+	s.seenSigned.Store(true)
+	return nil
+}
@@ -0,0 +1,137 @@
+package communicator
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sentineledge/agent/internal/clock"
+)
+
+// resetClock deja la estimación del reloj en cero para los tests que siguen
+func resetClock() {
+	for i := 0; i < 20; i++ {
+		now := time.Now()
+		clock.Observe(now, now, now)
+	}
+}
+
+func signedAt(t time.Time, body []byte) (sig, ts string) {
+	ts = strconv.FormatInt(t.Unix(), 10)
+	return signature(signingKey("secret"), []string{"200", "/commands/poll", ts}, body), ts
+}
+
+// signingServer responde los polls firmados con el reloj offset adelante
+// del local, y con un header Date que dice forgedDate
+func signingServer(t *testing.T, offset time.Duration, forgedDate time.Time) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := []byte(`[]`)
+		ts := strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Date", forgedDate.UTC().Format(http.TimeFormat))
+		w.Header().Set(TimestampHeader, ts)
+		w.Header().Set(SignatureHeader, signature(signingKey("secret"), []string{"200", r.URL.RequestURI(), ts}, body))
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestPollWithLocalClockTenMinutesOff(t *testing.T) {
+	resetClock()
+	t.Cleanup(resetClock)
+	srv := signingServer(t, 10*time.Minute, time.Now())
+	c := New([]string{srv.URL}, "token", "agent-1")
+	c.SetSigningSecret("secret")
+
+	// Las primeras respuestas firmadas alimentan el reloj hasta que la
+	// mediana es el desfase real; desde ahí se aceptan
+	var err error
+	for i := 0; i < 9; i++ {
+		if _, err = c.PollCommands(context.Background()); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatalf("poll still rejected after learning the skew: %v", err)
+	}
+	if skew, ok := clock.Skew(); !ok || (skew-10*time.Minute).Abs() > 2*time.Second {
+		t.Fatalf("Skew = %s, %v; want about 10m", skew, ok)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := c.PollCommands(context.Background()); err != nil {
+			t.Fatalf("poll %d rejected: %v", i, err)
+		}
+	}
+}
+
+func TestDateHeaderDoesNotMoveClock(t *testing.T) {
+	resetClock()
+	t.Cleanup(resetClock)
+	srv := signingServer(t, 0, time.Now().Add(time.Hour))
+	c := New([]string{srv.URL}, "token", "agent-1")
+	c.SetSigningSecret("secret")
+
+	for i := 0; i < 5; i++ {
+		if _, err := c.PollCommands(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if skew, _ := clock.Skew(); skew.Abs() > 2*time.Second {
+		t.Fatalf("Skew = %s, learned from the unsigned Date header", skew)
+	}
+}
+
+func TestBadSignatureIsNotAClockSample(t *testing.T) {
+	c := New([]string{"http://localhost"}, "token", "agent-1")
+	c.SetSigningSecret("secret")
+	body := []byte(`{"commands":[]}`)
+
+	observed := false
+	_, ts := signedAt(time.Now().Add(time.Hour), body)
+	err := c.verifySignature("v1=00", ts, []string{"200", "/commands/poll", ts}, body,
+		func(time.Time) { observed = true })
+	if !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("forged signature accepted: %v", err)
+	}
+	if observed {
+		t.Error("forged signature fed the clock")
+	}
+}
+
+func TestVerifySignatureRejectsStale(t *testing.T) {
+	resetClock()
+	t.Cleanup(resetClock)
+	c := New([]string{"http://localhost"}, "token", "agent-1")
+	c.SetSigningSecret("secret")
+	body := []byte(`{"commands":[]}`)
+
+	sig, ts := signedAt(time.Now().Add(-time.Hour), body)
+	if err := c.verifySignature(sig, ts, []string{"200", "/commands/poll", ts}, body, nil); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("hour-old signature accepted: %v", err)
+	}
+}
+
+func TestVerifySignatureRejectsUnsignedAfterSigned(t *testing.T) {
+	resetClock()
+	t.Cleanup(resetClock)
+	c := New([]string{"http://localhost"}, "token", "agent-1")
+	c.SetSigningSecret("secret")
+	body := []byte(`{}`)
+
+	if err := c.verifySignature("", "", nil, body, nil); err != nil {
+		t.Fatalf("unsigned response rejected before any signed one: %v", err)
+	}
+	sig, ts := signedAt(time.Now(), body)
+	if err := c.verifySignature(sig, ts, []string{"200", "/commands/poll", ts}, body, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.verifySignature("", "", nil, body, nil); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("unsigned response accepted after a signed one: %v", err)
+	}
+}
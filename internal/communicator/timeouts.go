@@ -0,0 +1,87 @@
+package communicator
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/sentineledge/agent/internal/bandwidth"
+)
+
+// Timeouts es el plazo de cada tipo de petición, por intento contra cada
+// endpoint del servidor. Sin plazo una conexión medio abierta puede dejar
+// una petición colgada para siempre. 0 deja solo el contexto de quien llama.
+type Timeouts struct {
+	Register    time.Duration
+	Poll        time.Duration
+	Result      time.Duration
+	Progress    time.Duration
+	Heartbeat   time.Duration
+	Inventory   time.Duration
+	Artifact    time.Duration // los archivos pueden ser mucho más grandes que un resultado
+	Certificate time.Duration
+	Token       time.Duration
+}
+
+// DefaultTimeouts son los plazos si la configuración no dice otra cosa
+var DefaultTimeouts = Timeouts{
+	Register:    60 * time.Second,
+	Poll:        30 * time.Second,
+	Result:      60 * time.Second,
+	Progress:    15 * time.Second,
+	Heartbeat:   20 * time.Second,
+	Inventory:   2 * time.Minute,
+	Artifact:    30 * time.Minute,
+	Certificate: 60 * time.Second,
+	Token:       30 * time.Second,
+}
+
+// SetTimeouts cambia los plazos de las peticiones siguientes
+func (c *Communicator) SetTimeouts(t Timeouts) {
+	c.timeouts.Store(&t)
+}
+
+func (c *Communicator) timeout() *Timeouts {
+	return c.timeouts.Load()
+}
+
+// withTimeout es context.WithTimeout salvo que d sea 0
+func withTimeout(ctx context.Context, d time.Duration) (context.Context, context.CancelFunc) {
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, d)
+}
+
+// uploadTimeout suma a d lo que tarda subir size bytes con el límite de
+// subida vigente: con un límite bajo un body grande pasa más tiempo
+// esperando en el limitador que hablando con el servidor. 0 sigue siendo
+// sin plazo.
+func uploadTimeout(d time.Duration, size int64) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d + bandwidth.TransferTime(bandwidth.Upload, size)
+}
+
+// bodySize es el tamaño del body de r tal como viaja. Un body que resty
+// todavía tiene que serializar solo se mide si hay límite de subida.
+func bodySize(r *resty.Request) int64 {
+	switch body := r.Body.(type) {
+	case nil:
+		return 0
+	case []byte:
+		return int64(len(body))
+	case string:
+		return int64(len(body))
+	}
+	if !bandwidth.Limited(bandwidth.Upload) {
+		return 0
+	}
+	data, err := json.Marshal(r.Body)
+	if err != nil {
+		return 0
+	}
+	return int64(len(data))
+}
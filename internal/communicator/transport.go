@@ -0,0 +1,84 @@
+package communicator
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"time"
+
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// Transport es el canal entre el agente y el servidor. Communicator (HTTP)
+// es la implementación principal; commtest.Memory sirve para pruebas. Los
+// errores de cualquier backend se expresan con los de errors.go. Cancelar
+// ctx aborta la llamada en curso y retorna el error de ctx.
+type Transport interface {
+	Register(ctx context.Context, req RegisterRequest) (*RegisterResponse, error)
+	PollCommands(ctx context.Context) (*PollResponse, error)
+	ReportResult(ctx context.Context, result models.Result) error
+	ReportProgress(ctx context.Context, p models.Progress) error
+	Heartbeat(ctx context.Context, hb models.Heartbeat) (*models.HeartbeatResponse, error)
+	SendInventory(ctx context.Context, inv *models.Inventory) error
+	UploadArtifact(ctx context.Context, jobID, name string, r io.Reader) error
+
+	// SetCredentials cambia ID y token tras registrarse o rotar el token
+	SetCredentials(agentID, token string)
+	// ActiveEndpoint describe a dónde está conectado, para el heartbeat
+	ActiveEndpoint() string
+}
+
+// Capacidades opcionales; el agente las usa si el transporte las tiene.
+
+// TokenRefresher rota el token del agente
+type TokenRefresher interface {
+	RefreshToken(ctx context.Context) (*TokenResponse, error)
+}
+
+// CertificateRenewer emite y usa certificados cliente
+type CertificateRenewer interface {
+	RenewCertificate(ctx context.Context, csr string) (string, error)
+	SetCertificate(cert *tls.Certificate)
+}
+
+// CommandStream entrega comandos apenas el servidor los envía, hasta que
+// ctx se cancele
+type CommandStream interface {
+	Run(ctx context.Context, out chan<- models.Command)
+	Connected() bool
+}
+
+// Pusher lo implementan los transportes con entrega push
+type Pusher interface {
+	NewPush() CommandStream
+}
+
+// LongPolling lo implementan los transportes que pueden retener el pedido
+// de comandos hasta que haya alguno
+type LongPolling interface {
+	NewLongPoll(wait time.Duration) *LongPoller
+}
+
+// RequestSigner firma peticiones y verifica respuestas con el secreto que
+// el servidor emite al registrar el agente
+type RequestSigner interface {
+	SetSigningSecret(secret string)
+}
+
+var (
+	_ Transport          = (*Communicator)(nil)
+	_ TokenRefresher     = (*Communicator)(nil)
+	_ CertificateRenewer = (*Communicator)(nil)
+	_ Pusher             = (*Communicator)(nil)
+	_ LongPolling        = (*Communicator)(nil)
+	_ RequestSigner      = (*Communicator)(nil)
+)
+
+// Register registra el agente contra los endpoints de este cliente
+func (c *Communicator) Register(ctx context.Context, req RegisterRequest) (*RegisterResponse, error) {
+	var urls []string
+	for _, e := range c.endpoints.snapshot() {
+		urls = append(urls, e.URL)
+	}
+	return register(ctx, urls, c.timeout().Register, req)
+}
@@ -0,0 +1,24 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+)
+
+// ArtifactsDirEnv es la variable de entorno con el directorio donde el
+// script deja archivos para subir al servidor al terminar el job, ej. un
+// log o un volcado. Solo se suben los archivos del primer nivel.
+const ArtifactsDirEnv = "SE_ARTIFACTS_DIR"
+
+// NewArtifactsDir crea el directorio de artefactos de un job dentro de
+// parent; quien lo crea lo borra después de subir su contenido
+func NewArtifactsDir(parent string) (string, error) {
+	if err := os.MkdirAll(parent, 0700); err != nil {
+		return "", fmt.Errorf("could not create artifacts directory: %w", err)
+	}
+	dir, err := os.MkdirTemp(parent, "job-*")
+	if err != nil {
+		return "", fmt.Errorf("could not create artifacts directory: %w", err)
+	}
+	return dir, nil
+}
@@ -0,0 +1,162 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// EncodingBase64 marca la salida que no es texto y se envía en base64
+const EncodingBase64 = "base64"
+
+// Code pages de Windows más comunes, por número
+var codePages = map[int]*charmap.Charmap{
+	437:  charmap.CodePage437,
+	850:  charmap.CodePage850,
+	852:  charmap.CodePage852,
+	855:  charmap.CodePage855,
+	858:  charmap.CodePage858,
+	860:  charmap.CodePage860,
+	862:  charmap.CodePage862,
+	863:  charmap.CodePage863,
+	865:  charmap.CodePage865,
+	866:  charmap.CodePage866,
+	874:  charmap.Windows874,
+	1250: charmap.Windows1250,
+	1251: charmap.Windows1251,
+	1252: charmap.Windows1252,
+	1253: charmap.Windows1253,
+	1254: charmap.Windows1254,
+	1255: charmap.Windows1255,
+	1256: charmap.Windows1256,
+	1257: charmap.Windows1257,
+	1258: charmap.Windows1258,
+}
+
+// LookupCodePage retorna la code page legacy con la que se decodifica la
+// salida que no es UTF-8 ni UTF-16. Acepta el número ("850", "cp1252") o
+// el nombre IANA ("IBM850", "windows-1252"). Vacío retorna nil: sin code
+// page esa salida va en base64.
+func LookupCodePage(name string) (encoding.Encoding, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, nil
+	}
+	num := strings.TrimPrefix(strings.ToLower(name), "cp")
+	if n, err := strconv.Atoi(num); err == nil {
+		if cm, ok := codePages[n]; ok {
+			return cm, nil
+		}
+		return nil, fmt.Errorf("unsupported code page %d", n)
+	}
+	enc, err := ianaindex.IANA.Encoding(name)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unknown code page %q", name)
+	}
+	return enc, nil
+}
+
+// encodeOutput convierte la salida cruda de un proceso a UTF-8. Si no se
+// puede interpretar como texto se retorna en base64 con su marcador.
+func encodeOutput(raw []byte, codePage encoding.Encoding) (text string, enc string) {
+	if len(raw) == 0 {
+		return "", ""
+	}
+	if decoded, ok := decode(raw, codePage); ok {
+		return string(decoded), ""
+	}
+	return base64.StdEncoding.EncodeToString(raw), EncodingBase64
+}
+
+// decodeText es como encodeOutput pero para archivos que el script escribe;
+// si no es texto válido se retorna tal cual.
+func decodeText(raw []byte, codePage encoding.Encoding) []byte {
+	if decoded, ok := decode(raw, codePage); ok {
+		return decoded
+	}
+	return raw
+}
+
+func decode(raw []byte, codePage encoding.Encoding) ([]byte, bool) {
+	switch {
+	case bytes.HasPrefix(raw, []byte{0xef, 0xbb, 0xbf}):
+		raw = raw[3:]
+	case bytes.HasPrefix(raw, []byte{0xff, 0xfe}):
+		return decodeWith(unicode.UTF16(unicode.LittleEndian, unicode.ExpectBOM), raw)
+	case bytes.HasPrefix(raw, []byte{0xfe, 0xff}):
+		return decodeWith(unicode.UTF16(unicode.BigEndian, unicode.ExpectBOM), raw)
+	}
+
+	if order, ok := looksUTF16(raw); ok {
+		return decodeWith(unicode.UTF16(order, unicode.IgnoreBOM), raw)
+	}
+
+	if utf8.Valid(raw) {
+		if looksBinary(raw) {
+			return nil, false
+		}
+		return raw, true
+	}
+
+	if codePage != nil {
+		return decodeWith(codePage, raw)
+	}
+	return nil, false
+}
+
+func decodeWith(enc encoding.Encoding, raw []byte) ([]byte, bool) {
+	out, err := enc.NewDecoder().Bytes(raw)
+	if err != nil || !utf8.Valid(out) || looksBinary(out) {
+		return nil, false
+	}
+	return out, true
+}
+
+// looksUTF16 detecta UTF-16 sin BOM: texto mayormente ASCII deja un byte
+// cero en cada par, en la posición impar (LE) o par (BE)
+func looksUTF16(raw []byte) (unicode.Endianness, bool) {
+	if len(raw) < 4 || len(raw)%2 != 0 {
+		return unicode.LittleEndian, false
+	}
+	var evenZeros, oddZeros int
+	for i := 0; i < len(raw); i += 2 {
+		if raw[i] == 0 {
+			evenZeros++
+		}
+		if raw[i+1] == 0 {
+			oddZeros++
+		}
+	}
+	pairs := len(raw) / 2
+	switch {
+	case oddZeros*10 >= pairs*7 && evenZeros*10 < pairs:
+		return unicode.LittleEndian, true
+	case evenZeros*10 >= pairs*7 && oddZeros*10 < pairs:
+		return unicode.BigEndian, true
+	}
+	return unicode.LittleEndian, false
+}
+
+// looksBinary marca como binario lo que tenga NUL o demasiados caracteres
+// de control fuera de los usuales en texto de consola
+func looksBinary(text []byte) bool {
+	var control, total int
+	for _, r := range string(text) {
+		total++
+		if r == 0 {
+			return true
+		}
+		if r < 0x20 && r != '\n' && r != '\r' && r != '\t' && r != '\f' && r != '\b' && r != 0x1b {
+			control++
+		}
+	}
+	return total > 0 && control*10 > total
+}
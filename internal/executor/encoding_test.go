@@ -0,0 +1,83 @@
+package executor
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncodeOutput(t *testing.T) {
+	tests := []struct {
+		fixture  string
+		codePage string
+		want     string
+		wantEnc  string
+	}{
+		{"cp850.txt", "850", "Configuración IP de Windows\r\nDirección IPv4: 10.0.0.5\r\n", ""},
+		{"cp850.txt", "IBM850", "Configuración IP de Windows\r\nDirección IPv4: 10.0.0.5\r\n", ""},
+		{"cp437.txt", "cp437", "Directorio de C:\\Users\\Müller ÄÖÜ ñ\r\n", ""},
+		{"cp866.txt", "866", "Том в устройстве C не имеет метки.\r\n", ""},
+		{"utf16le-bom.txt", "", "Nombre   Versión\r\n7-Zip    23.01 ✓\r\n", ""},
+		{"utf16le-nobom.txt", "", "Nombre   Versión\r\n7-Zip    23.01\r\n", ""},
+		// UTF-16 se reconoce antes que la code page
+		{"utf16le-nobom.txt", "850", "Nombre   Versión\r\n7-Zip    23.01\r\n", ""},
+		{"utf8-bom.txt", "", "añadido ✓\n", ""},
+		{"utf8-bom.txt", "850", "añadido ✓\n", ""},
+		// Sin code page la salida legacy no se adivina
+		{"cp850.txt", "", "", EncodingBase64},
+		{"binary.bin", "", "", EncodingBase64},
+		{"binary.bin", "1252", "", EncodingBase64},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture+"/"+tt.codePage, func(t *testing.T) {
+			raw, err := os.ReadFile(filepath.Join("testdata", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			codePage, err := LookupCodePage(tt.codePage)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			text, enc := encodeOutput(raw, codePage)
+			if enc != tt.wantEnc {
+				t.Fatalf("encoding = %q, want %q", enc, tt.wantEnc)
+			}
+			if enc == EncodingBase64 {
+				got, err := base64.StdEncoding.DecodeString(text)
+				if err != nil || string(got) != string(raw) {
+					t.Fatalf("base64 output does not round-trip")
+				}
+				return
+			}
+			if text != tt.want {
+				t.Errorf("text = %q, want %q", text, tt.want)
+			}
+		})
+	}
+}
+
+func TestLookupCodePage(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantNil bool
+		wantErr bool
+	}{
+		{"", true, false},
+		{"850", false, false},
+		{"CP1252", false, false},
+		{"windows-1251", false, false},
+		{"999", true, true},
+		{"klingon", true, true},
+	}
+	for _, tt := range tests {
+		enc, err := LookupCodePage(tt.name)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("LookupCodePage(%q) error = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		if (enc == nil) != tt.wantNil {
+			t.Errorf("LookupCodePage(%q) = %v, want nil %v", tt.name, enc, tt.wantNil)
+		}
+	}
+}
@@ -3,14 +3,35 @@ package executor
 import (
 	"bytes"
 	"context"
+	"log"
+	"os"
 	"os/exec"
+	"runtime"
 	"time"
 
+	"github.com/sentineledge/agent/internal/clock"
 	"github.com/sentineledge/agent/internal/updater"
 	"github.com/sentineledge/agent/pkg/models"
+	"golang.org/x/text/encoding"
 )
 
+// CommandTypes son los tipos de comando que este agente sabe ejecutar
+func CommandTypes() []string {
+	if runtime.GOOS == "windows" {
+		return []string{"powershell", "update"}
+	}
+	return []string{"bash"}
+}
+
 func Execute(cmd models.Command) models.Result {
+	return ExecuteWithProgress(cmd, nil, "", nil)
+}
+
+// ExecuteWithProgress corre el comando y entrega a onProgress lo que el
+// script escriba en SE_PROGRESS_FILE mientras está corriendo. codePage
+// decodifica la salida que no es UTF-8 ni UTF-16; ver LookupCodePage. Si
+// artifactsDir no es vacío se expone al script en SE_ARTIFACTS_DIR.
+func ExecuteWithProgress(cmd models.Command, codePage encoding.Encoding, artifactsDir string, onProgress func(models.Progress)) models.Result {
 	result := models.Result{
 		JobID: cmd.ID,
 	}
@@ -24,7 +45,7 @@ func Execute(cmd models.Command) models.Result {
 			result.ExitCode = 0
 			result.Stdout = "Update initiated — service restarting"
 		}
-		result.FinishedAt = time.Now().UTC()
+		result.FinishedAt, result.FinishedAtLocal = clock.Now().UTC(), time.Now().UTC()
 		return result
 	}
 
@@ -52,15 +73,50 @@ func Execute(cmd models.Command) models.Result {
 		)
 	}
 
+	execCmd.Env = os.Environ()
+
+	// Canal dedicado para que el script retorne datos estructurados
+	outputPath, err := newOutputFile()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	} else {
+		defer os.Remove(outputPath)
+		execCmd.Env = append(execCmd.Env, OutputFileEnv+"="+outputPath)
+	}
+
+	if artifactsDir != "" {
+		execCmd.Env = append(execCmd.Env, ArtifactsDirEnv+"="+artifactsDir)
+	}
+
+	if onProgress != nil {
+		watcher, err := newProgressWatcher(cmd.ID, codePage, onProgress)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		} else {
+			execCmd.Env = append(execCmd.Env, ProgressFileEnv+"="+watcher.path)
+			watcher.start()
+			defer watcher.stop()
+		}
+	}
+
 	var stdout, stderr bytes.Buffer
 	execCmd.Stdout = &stdout
 	execCmd.Stderr = &stderr
 
-	err := execCmd.Run()
+	err = execCmd.Run()
+
+	result.Stdout, result.StdoutEncoding = encodeOutput(stdout.Bytes(), codePage)
+	result.Stderr, result.StderrEncoding = encodeOutput(stderr.Bytes(), codePage)
+	result.FinishedAt, result.FinishedAtLocal = clock.Now().UTC(), time.Now().UTC()
 
-	result.Stdout = stdout.String()
-	result.Stderr = stderr.String()
-	result.FinishedAt = time.Now().UTC()
+	if outputPath != "" {
+		data, dataErr := readOutputFile(outputPath, codePage)
+		if dataErr != nil {
+			result.DataError = dataErr.Error()
+		} else {
+			result.Data = data
+		}
+	}
 
 	if err != nil {
 		if exitErr, ok := err.(*exec.ExitError); ok {
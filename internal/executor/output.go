@@ -0,0 +1,56 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/text/encoding"
+)
+
+// OutputFileEnv es la variable de entorno con la ruta donde el script
+// puede escribir su resultado estructurado en JSON
+const OutputFileEnv = "SE_OUTPUT_FILE"
+
+// maxOutputData limita el tamaño del JSON que se adjunta al resultado
+const maxOutputData = 1 << 20
+
+// newOutputFile crea el archivo temporal que se expone al script
+func newOutputFile() (string, error) {
+	f, err := os.CreateTemp("", "se-output-*.json")
+	if err != nil {
+		return "", fmt.Errorf("could not create output file: %w", err)
+	}
+	path := f.Name()
+	f.Close()
+	return path, nil
+}
+
+// readOutputFile lee y valida el JSON que dejó el script.
+// Retorna nil si el script no escribió nada.
+func readOutputFile(path string, codePage encoding.Encoding) (json.RawMessage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(io.LimitReader(f, maxOutputData+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxOutputData {
+		return nil, fmt.Errorf("output data exceeds %d bytes", maxOutputData)
+	}
+	// Out-File en Windows PowerShell 5 escribe UTF-16 por defecto
+	data = bytes.TrimSpace(decodeText(data, codePage))
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if !json.Valid(data) {
+		return nil, fmt.Errorf("output data is not valid JSON")
+	}
+	return json.RawMessage(data), nil
+}
@@ -0,0 +1,217 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sentineledge/agent/internal/clock"
+	"github.com/sentineledge/agent/pkg/models"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// ProgressFileEnv es la variable de entorno con la ruta donde el script
+// reporta su avance, una línea por evento: "<porcentaje> <mensaje>".
+//
+//	bash:       echo "40 Downloading updates" >> "$SE_PROGRESS_FILE"
+//	powershell: Add-Content $env:SE_PROGRESS_FILE "40 Downloading updates"
+const ProgressFileEnv = "SE_PROGRESS_FILE"
+
+const progressPollInterval = time.Second
+
+// progressWatcher lee las líneas nuevas del archivo de progreso mientras
+// el job está corriendo y las entrega a onProgress
+type progressWatcher struct {
+	jobID      string
+	path       string
+	codePage   encoding.Encoding
+	onProgress func(models.Progress)
+
+	offset int64
+	// UTF-16 se detecta en la primera lectura y se decodifica antes de
+	// separar líneas: el byte 0x0a de un "\n" va seguido de 0x00
+	detected bool
+	utf16    bool
+	order    unicode.Endianness
+	pending  []byte // bytes leídos sin decodificar: un byte suelto o un subrogado alto
+	partial  []byte // línea sin terminar
+	percent  int
+	done     chan struct{}
+	stopped  chan struct{}
+}
+
+func newProgressWatcher(jobID string, codePage encoding.Encoding, onProgress func(models.Progress)) (*progressWatcher, error) {
+	f, err := os.CreateTemp("", "se-progress-*.txt")
+	if err != nil {
+		return nil, fmt.Errorf("could not create progress file: %w", err)
+	}
+	path := f.Name()
+	f.Close()
+
+	return &progressWatcher{
+		jobID:      jobID,
+		path:       path,
+		codePage:   codePage,
+		onProgress: onProgress,
+		percent:    -1,
+		done:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}, nil
+}
+
+func (w *progressWatcher) start() {
+	go func() {
+		defer close(w.stopped)
+		ticker := time.NewTicker(progressPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				w.read(false)
+			case <-w.done:
+				w.read(true)
+				return
+			}
+		}
+	}()
+}
+
+// stop hace una última lectura y elimina el archivo
+func (w *progressWatcher) stop() {
+	close(w.done)
+	<-w.stopped
+	os.Remove(w.path)
+}
+
+func (w *progressWatcher) read(final bool) {
+	f, err := os.Open(w.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	// Si el script truncó o reescribió el archivo (">" en bash, Set-Content
+	// u Out-File en PowerShell) el offset queda más allá del final
+	if info, err := f.Stat(); err == nil && info.Size() < w.offset {
+		w.offset = 0
+		w.detected = false
+		w.pending = nil
+		w.partial = nil
+	}
+
+	if _, err := f.Seek(w.offset, io.SeekStart); err != nil {
+		return
+	}
+	chunk, err := io.ReadAll(f)
+	if err != nil || len(chunk) == 0 && !final {
+		return
+	}
+	w.offset += int64(len(chunk))
+
+	text, ok := w.decodeChunk(append(w.pending, chunk...), final)
+	if !ok {
+		return
+	}
+	buf := append(w.partial, text...)
+	lastNL := bytes.LastIndexByte(buf, '\n')
+	if final {
+		lastNL = len(buf) - 1
+	}
+	if lastNL < 0 {
+		w.partial = buf
+		return
+	}
+	complete := buf[:lastNL+1]
+	w.partial = append([]byte(nil), buf[lastNL+1:]...)
+
+	if !w.utf16 {
+		complete = decodeText(complete, w.codePage)
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(complete))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		w.onProgress(w.parse(line))
+	}
+}
+
+// decodeChunk retorna buf como texto listo para separar en líneas: UTF-16
+// ya convertido a UTF-8, cualquier otra cosa tal cual para decodificarla
+// línea por línea. Lo que no se puede decodificar todavía queda en
+// pending. ok es false si hacen falta más bytes para detectar la
+// codificación.
+func (w *progressWatcher) decodeChunk(buf []byte, final bool) (text []byte, ok bool) {
+	w.pending = nil
+	if !w.detected {
+		if len(buf) < 4 && !final {
+			w.pending = buf
+			return nil, false
+		}
+		w.detected = true
+		switch {
+		case bytes.HasPrefix(buf, []byte{0xff, 0xfe}):
+			w.utf16, w.order, buf = true, unicode.LittleEndian, buf[2:]
+		case bytes.HasPrefix(buf, []byte{0xfe, 0xff}):
+			w.utf16, w.order, buf = true, unicode.BigEndian, buf[2:]
+		default:
+			w.order, w.utf16 = looksUTF16(buf[:len(buf)&^1])
+		}
+	}
+	if !w.utf16 {
+		return buf, true
+	}
+
+	n := len(buf) &^ 1
+	if n >= 2 && !final && isHighSurrogate(buf[n-2:n], w.order) {
+		// El par subrogado sigue en la próxima lectura
+		n -= 2
+	}
+	w.pending = append([]byte(nil), buf[n:]...)
+	out, err := unicode.UTF16(w.order, unicode.IgnoreBOM).NewDecoder().Bytes(buf[:n])
+	if err != nil {
+		return nil, true
+	}
+	return out, true
+}
+
+func isHighSurrogate(unit []byte, order unicode.Endianness) bool {
+	u := uint16(unit[0])<<8 | uint16(unit[1])
+	if order == unicode.LittleEndian {
+		u = uint16(unit[1])<<8 | uint16(unit[0])
+	}
+	return u >= 0xd800 && u < 0xdc00
+}
+
+// parse interpreta "<porcentaje> <mensaje>". Si la línea no empieza con
+// un número se toma completa como mensaje y se conserva el último porcentaje.
+func (w *progressWatcher) parse(line string) models.Progress {
+	p := models.Progress{
+		JobID:   w.jobID,
+		At:      clock.Now().UTC(),
+		AtLocal: time.Now().UTC(),
+	}
+
+	first, rest, _ := strings.Cut(line, " ")
+	if pct, err := strconv.Atoi(strings.TrimSuffix(first, "%")); err == nil {
+		if pct < 0 {
+			pct = 0
+		}
+		if pct > 100 {
+			pct = 100
+		}
+		w.percent = pct
+		p.Message = strings.TrimSpace(rest)
+	} else {
+		p.Message = line
+	}
+	p.Percent = w.percent
+	return p
+}
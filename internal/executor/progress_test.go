@@ -0,0 +1,142 @@
+package executor
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/sentineledge/agent/pkg/models"
+	"golang.org/x/text/encoding/charmap"
+)
+
+// appendTo agrega data al archivo de progreso y hace una lectura, como si
+// el script escribiera entre dos ticks
+func appendTo(t *testing.T, w *progressWatcher, data []byte, final bool) {
+	t.Helper()
+	f, err := os.OpenFile(w.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	w.read(final)
+}
+
+func utf16le(s string) []byte {
+	var out []byte
+	for _, r := range s {
+		if r > 0xffff {
+			r -= 0x10000
+			hi, lo := 0xd800+(r>>10), 0xdc00+(r&0x3ff)
+			out = append(out, byte(hi), byte(hi>>8), byte(lo), byte(lo>>8))
+			continue
+		}
+		out = append(out, byte(r), byte(r>>8))
+	}
+	return out
+}
+
+func TestProgressWatcherSplitChunks(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     []byte
+		cuts     []int // dónde se parte el archivo entre lecturas
+		messages []string
+		percents []int
+	}{
+		{
+			name:     "utf8",
+			data:     []byte("10 Descargando\n55 Instalando…\n"),
+			cuts:     []int{3, 16, 20},
+			messages: []string{"Descargando", "Instalando…"},
+			percents: []int{10, 55},
+		},
+		{
+			// Out-File de PowerShell 5: BOM y "\n" como 0a 00
+			name:     "utf16le bom",
+			data:     append([]byte{0xff, 0xfe}, utf16le("20 Descargando\r\n80 Listo ✓\r\n")...),
+			cuts:     []int{1, 3, 31, 32, 33},
+			messages: []string{"Descargando", "Listo ✓"},
+			percents: []int{20, 80},
+		},
+		{
+			name:     "utf16le no bom",
+			data:     utf16le("30 Paso uno\n90 Paso dos\n"),
+			cuts:     []int{2, 23, 24, 25},
+			messages: []string{"Paso uno", "Paso dos"},
+			percents: []int{30, 90},
+		},
+		{
+			// Par subrogado partido entre dos lecturas
+			name:     "utf16le surrogate",
+			data:     utf16le("40 Copiando 📦\n"),
+			cuts:     []int{24, 26},
+			messages: []string{"Copiando 📦"},
+			percents: []int{40},
+		},
+		{
+			name:     "cp850",
+			data:     []byte{'5', '0', ' ', 'C', 'o', 'n', 'f', 'i', 'g', 'u', 'r', 'a', 'c', 'i', 0xa2, 'n', '\n'},
+			cuts:     []int{9},
+			messages: []string{"Configuración"},
+			percents: []int{50},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []models.Progress
+			w, err := newProgressWatcher("job-1", charmap.CodePage850, func(p models.Progress) {
+				got = append(got, p)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(w.path)
+
+			prev := 0
+			for _, cut := range tt.cuts {
+				appendTo(t, w, tt.data[prev:cut], false)
+				prev = cut
+			}
+			appendTo(t, w, tt.data[prev:], true)
+
+			var messages []string
+			var percents []int
+			for _, p := range got {
+				messages = append(messages, p.Message)
+				percents = append(percents, p.Percent)
+			}
+			if !reflect.DeepEqual(messages, tt.messages) {
+				t.Errorf("messages = %q, want %q", messages, tt.messages)
+			}
+			if !reflect.DeepEqual(percents, tt.percents) {
+				t.Errorf("percents = %v, want %v", percents, tt.percents)
+			}
+		})
+	}
+}
+
+func TestProgressWatcherTruncate(t *testing.T) {
+	var got []string
+	w, err := newProgressWatcher("job-1", nil, func(p models.Progress) {
+		got = append(got, p.Message)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(w.path)
+
+	appendTo(t, w, []byte("10 primera línea bastante larga\n"), false)
+	// Set-Content reescribe el archivo, ahora en UTF-16
+	if err := os.WriteFile(w.path, append([]byte{0xff, 0xfe}, utf16le("60 nueva\n")...), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	w.read(true)
+
+	want := []string{"primera línea bastante larga", "nueva"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package identity
+
+// restrictAccess no hace nada fuera de Windows; alcanza con los permisos
+// del archivo
+func restrictAccess(path string) error {
+	return nil
+}
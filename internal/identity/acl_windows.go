@@ -0,0 +1,29 @@
+package identity
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/windows"
+)
+
+// keySDDL da control total solo a SYSTEM y a Administradores, sin heredar
+// los permisos de la carpeta: en Windows los bits 0600 no significan nada
+const keySDDL = "D:P(A;;FA;;;SY)(A;;FA;;;BA)"
+
+func restrictAccess(path string) error {
+	sd, err := windows.SecurityDescriptorFromString(keySDDL)
+	if err != nil {
+		return fmt.Errorf("invalid security descriptor: %w", err)
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return fmt.Errorf("invalid security descriptor: %w", err)
+	}
+	err = windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT,
+		windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION,
+		nil, nil, dacl, nil)
+	if err != nil {
+		return fmt.Errorf("could not restrict access to %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+package identity
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// KeyFile guarda la llave y la cadena de certificados juntas, así un
+	// solo rename reemplaza el par completo
+	KeyFile = "agent.key"
+	// CertFile es donde versiones anteriores guardaban el certificado aparte
+	CertFile = "agent.crt"
+)
+
+// Identity es el certificado cliente que el servidor emitió para el agente
+type Identity struct {
+	cert tls.Certificate
+	leaf *x509.Certificate
+	key  crypto.Signer
+}
+
+// Pending es una llave recién generada esperando su certificado
+type Pending struct {
+	key *ecdsa.PrivateKey
+	CSR string // PEM
+}
+
+// GenerateCSR crea una llave ECDSA P-256 y su CSR. La llave solo se escribe
+// a disco cuando el servidor devuelve el certificado.
+func GenerateCSR(commonName string) (*Pending, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("key generation failed: %w", err)
+	}
+
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: commonName},
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("CSR creation failed: %w", err)
+	}
+
+	return &Pending{
+		key: key,
+		CSR: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der})),
+	}, nil
+}
+
+// Complete une la llave con el certificado emitido por el servidor
+func (p *Pending) Complete(certPEM string) (*Identity, error) {
+	keyDER, err := x509.MarshalECPrivateKey(p.key)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return parse([]byte(certPEM), keyPEM)
+}
+
+func parse(certPEM, keyPEM []byte) (*Identity, error) {
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("certificate does not match key: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificate: %w", err)
+	}
+	cert.Leaf = leaf
+
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	return &Identity{cert: cert, leaf: leaf, key: signer}, nil
+}
+
+// Load lee la identidad de dir. Retorna os.ErrNotExist si el agente
+// todavía no tiene certificado. Si agent.key no trae el certificado es de
+// una versión anterior y se lee agent.crt; parse rechaza el par si la
+// llave y el certificado no coinciden.
+func Load(dir string) (*Identity, error) {
+	keyPEM, err := os.ReadFile(filepath.Join(dir, KeyFile))
+	if err != nil {
+		return nil, err
+	}
+	certPEM := keyPEM
+	if !hasCertificate(keyPEM) {
+		if certPEM, err = os.ReadFile(filepath.Join(dir, CertFile)); err != nil {
+			return nil, err
+		}
+	}
+	return parse(certPEM, keyPEM)
+}
+
+func hasCertificate(data []byte) bool {
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			return false
+		}
+		if block.Type == "CERTIFICATE" {
+			return true
+		}
+	}
+}
+
+// Save escribe llave y certificado juntos en agent.key, con acceso solo
+// para el servicio, y lo renombra en un paso para no dejar un par a medias
+// si el proceso muere. El agent.crt de versiones anteriores se borra.
+func (id *Identity) Save(dir string) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(id.key)
+	if err != nil {
+		return err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+
+	var certPEM []byte
+	for _, der := range id.cert.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, KeyFile), append(keyPEM, certPEM...), 0600); err != nil {
+		return fmt.Errorf("could not save key: %w", err)
+	}
+	if err := os.Remove(filepath.Join(dir, CertFile)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not remove old certificate: %w", err)
+	}
+	return nil
+}
+
+// Certificate retorna el par para usar en tls.Config
+func (id *Identity) Certificate() *tls.Certificate {
+	return &id.cert
+}
+
+func (id *Identity) NotAfter() time.Time {
+	return id.leaf.NotAfter
+}
+
+// NeedsRenewal es true cuando queda menos de un tercio de la vigencia
+func (id *Identity) NeedsRenewal(now time.Time) bool {
+	lifetime := id.leaf.NotAfter.Sub(id.leaf.NotBefore)
+	return id.leaf.NotAfter.Sub(now) < lifetime/3
+}
+
+// writeFileAtomic restringe el acceso al archivo temporal antes de escribir
+// la llave, y recién entonces lo renombra sobre path
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+	// OpenFile no cambia permisos de un archivo existente
+	err = os.Chmod(tmp, perm)
+	if err == nil {
+		err = restrictAccess(tmp)
+	}
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,245 @@
+package network
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// Options es la configuración de red común a la API, Vaultwarden y el
+// updater. Cada destino tiene su lista de pins porque cada uno tiene su
+// certificado; una lista vacía deja solo la verificación contra las CAs.
+type Options struct {
+	CABundle    string   // PEM con CAs adicionales, ej. la de un proxy que inspecciona TLS
+	Pins        []string // hashes SPKI "sha256/<base64>" del servidor del agente; si hay, al menos uno debe coincidir
+	VaultPins   []string // ídem para Vaultwarden, que guarda el token y el secreto de firma
+	UpdaterPins []string // ídem para las descargas del updater, binarios que corren como SYSTEM/root
+	Proxy       ProxyOptions
+}
+
+// Target es el destino de una conexión, para elegir sus pins
+type Target int
+
+const (
+	API Target = iota
+	Vault
+	Updater
+)
+
+// ProxyOptions configura un proxy HTTP explícito. Sin URL se usan las
+// variables de entorno HTTPS_PROXY/NO_PROXY como siempre.
+type ProxyOptions struct {
+	URL      string
+	Username string
+	Password string
+	NoProxy  []string // hosts, dominios (".corp.local") o CIDRs que van directo
+}
+
+var (
+	mu    sync.RWMutex
+	roots *x509.CertPool // nil = trust store del sistema
+	pins  map[Target]map[string]bool
+	proxy func(*http.Request) (*url.URL, error)
+	// proxyURL es la URL configurada, sin credenciales, para diagnóstico
+	proxyURL *url.URL
+)
+
+// Configure carga el CA bundle y los pins. Si algo es inválido retorna
+// error: mejor no conectar que conectar sin la verificación pedida.
+func Configure(opts Options) error {
+	var pool *x509.CertPool
+	if opts.CABundle != "" {
+		pem, err := os.ReadFile(opts.CABundle)
+		if err != nil {
+			return fmt.Errorf("could not read CA bundle: %w", err)
+		}
+		pool, err = x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("CA bundle %s contains no PEM certificates", opts.CABundle)
+		}
+	}
+
+	pinSets := make(map[Target]map[string]bool)
+	for target, list := range map[Target][]string{API: opts.Pins, Vault: opts.VaultPins, Updater: opts.UpdaterPins} {
+		set, err := parsePins(list)
+		if err != nil {
+			return err
+		}
+		pinSets[target] = set
+	}
+
+	proxyFunc, pURL, err := buildProxy(opts.Proxy)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	roots = pool
+	pins = pinSets
+	proxy = proxyFunc
+	proxyURL = pURL
+	mu.Unlock()
+	return nil
+}
+
+// parsePins valida una lista de pins; nil si está vacía
+func parsePins(list []string) (map[string]bool, error) {
+	var set map[string]bool
+	for _, pin := range list {
+		pin = strings.TrimSpace(pin)
+		raw, ok := strings.CutPrefix(pin, "sha256/")
+		if !ok {
+			return nil, fmt.Errorf("invalid pin %q: expected sha256/<base64>", pin)
+		}
+		if b, err := base64.StdEncoding.DecodeString(raw); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid pin %q: not a base64 SHA-256 hash", pin)
+		}
+		if set == nil {
+			set = make(map[string]bool)
+		}
+		set[pin] = true
+	}
+	return set, nil
+}
+
+func buildProxy(opts ProxyOptions) (func(*http.Request) (*url.URL, error), *url.URL, error) {
+	if opts.URL == "" {
+		return http.ProxyFromEnvironment, nil, nil
+	}
+
+	u, err := url.Parse(opts.URL)
+	if err != nil || u.Host == "" {
+		return nil, nil, fmt.Errorf("invalid proxy URL %q", opts.URL)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	display := *u
+	display.User = nil
+
+	// Las credenciales en la URL hacen que net/http envíe Proxy-Authorization
+	if opts.Username != "" {
+		u.User = url.UserPassword(opts.Username, opts.Password)
+	}
+
+	cfg := &httpproxy.Config{
+		HTTPProxy:  u.String(),
+		HTTPSProxy: u.String(),
+		NoProxy:    strings.Join(opts.NoProxy, ","),
+	}
+	fn := cfg.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return fn(req.URL)
+	}, &display, nil
+}
+
+// Proxy retorna la función de proxy configurada, para clientes que no
+// usan Transport (ej. el dialer del WebSocket)
+func Proxy() func(*http.Request) (*url.URL, error) {
+	mu.RLock()
+	defer mu.RUnlock()
+	if proxy == nil {
+		return http.ProxyFromEnvironment
+	}
+	return proxy
+}
+
+// ProxyURL retorna el proxy explícito configurado, sin credenciales, o nil
+func ProxyURL() *url.URL {
+	mu.RLock()
+	defer mu.RUnlock()
+	return proxyURL
+}
+
+// TLSConfig retorna una configuración nueva con el CA bundle, sin pins
+func TLSConfig() *tls.Config {
+	mu.RLock()
+	defer mu.RUnlock()
+	return &tls.Config{
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+	}
+}
+
+// PinnedTLSConfig es TLSConfig más los pins, para conectar con el servidor
+// del agente
+func PinnedTLSConfig() *tls.Config {
+	return TargetTLSConfig(API)
+}
+
+// TargetTLSConfig es TLSConfig más los pins de target
+func TargetTLSConfig(target Target) *tls.Config {
+	cfg := TLSConfig()
+	mu.RLock()
+	pinSet := pins[target]
+	mu.RUnlock()
+	if len(pinSet) > 0 {
+		cfg.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pinSet)
+		}
+	}
+	return cfg
+}
+
+// Transport retorna un http.Transport con TLSConfig y el proxy aplicados
+func Transport() *http.Transport {
+	return newTransport(TLSConfig())
+}
+
+// PinnedTransport es Transport con PinnedTLSConfig, para el servidor del
+// agente
+func PinnedTransport() *http.Transport {
+	return TargetTransport(API)
+}
+
+// TargetTransport es Transport con los pins de target
+func TargetTransport(target Target) *http.Transport {
+	return newTransport(TargetTLSConfig(target))
+}
+
+func newTransport(tlsConfig *tls.Config) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = tlsConfig
+	t.Proxy = Proxy()
+	return t
+}
+
+// SPKIHash calcula el pin de un certificado en el formato de Options.Pins
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return "sha256/" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// verifyPins acepta la conexión si algún certificado de la cadena
+// verificada coincide con un pin
+func verifyPins(cs tls.ConnectionState, pinSet map[string]bool) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			if pinSet[SPKIHash(cert)] {
+				return nil
+			}
+		}
+	}
+
+	host := cs.ServerName
+	if host == "" {
+		host = "server"
+	}
+	got := "no certificate"
+	if len(cs.PeerCertificates) > 0 {
+		got = SPKIHash(cs.PeerCertificates[0])
+	}
+	return fmt.Errorf("certificate pin mismatch for %s: server presented %s, which matches no configured pin", host, got)
+}
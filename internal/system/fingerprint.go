@@ -0,0 +1,151 @@
+package system
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// Valores de relleno que algunos fabricantes dejan en DMI; no identifican
+// nada y harían coincidir máquinas distintas
+var placeholderIDs = map[string]bool{
+	"":                                     true,
+	"0":                                    true,
+	"none":                                 true,
+	"default string":                       true,
+	"to be filled by o.e.m.":               true,
+	"system serial number":                 true,
+	"not specified":                        true,
+	"not applicable":                       true,
+	"00000000-0000-0000-0000-000000000000": true,
+	"ffffffff-ffff-ffff-ffff-ffffffffffff": true,
+	"03000200-0400-0500-0006-000700080009": true,
+}
+
+func cleanID(s string) string {
+	s = strings.TrimSpace(s)
+	if placeholderIDs[strings.ToLower(s)] {
+		return ""
+	}
+	return s
+}
+
+// CollectFingerprint reúne los identificadores estables de la máquina:
+// machine-id (MachineGuid en Windows), UUID y serial de DMI, y el hash de
+// la MAC de la interfaz principal
+func CollectFingerprint() *models.Fingerprint {
+	fp := &models.Fingerprint{}
+
+	if runtime.GOOS == "windows" {
+		fingerprintWindows(fp)
+	} else {
+		fingerprintLinux(fp)
+	}
+
+	if mac := primaryMAC(); mac != "" {
+		sum := sha256.Sum256([]byte(strings.ToLower(mac)))
+		fp.MACHash = hex.EncodeToString(sum[:])
+	}
+
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		fp.MachineID, strings.ToLower(fp.DMIUUID), fp.Serial, fp.MACHash,
+	}, "|")))
+	fp.ID = hex.EncodeToString(sum[:])
+	return fp
+}
+
+func fingerprintLinux(fp *models.Fingerprint) {
+	for _, path := range []string{"/etc/machine-id", "/var/lib/dbus/machine-id"} {
+		if data, err := os.ReadFile(path); err == nil {
+			if fp.MachineID = cleanID(string(data)); fp.MachineID != "" {
+				break
+			}
+		}
+	}
+	// product_uuid y product_serial solo los lee root; el servicio corre así
+	if data, err := os.ReadFile("/sys/class/dmi/id/product_uuid"); err == nil {
+		fp.DMIUUID = cleanID(string(data))
+	}
+	if data, err := os.ReadFile("/sys/class/dmi/id/product_serial"); err == nil {
+		fp.Serial = cleanID(string(data))
+	}
+}
+
+func fingerprintWindows(fp *models.Fingerprint) {
+	script := `
+$ErrorActionPreference = 'SilentlyContinue'
+@{
+    machine_id = (Get-ItemProperty 'HKLM:\SOFTWARE\Microsoft\Cryptography').MachineGuid
+    dmi_uuid   = (Get-WmiObject Win32_ComputerSystemProduct).UUID
+    serial     = (Get-WmiObject Win32_BIOS).SerialNumber
+} | ConvertTo-Json -Compress
+`
+	out, err := runPowerShell(script)
+	if err != nil {
+		return
+	}
+	var raw struct {
+		MachineID string `json:"machine_id"`
+		DMIUUID   string `json:"dmi_uuid"`
+		Serial    string `json:"serial"`
+	}
+	if json.Unmarshal([]byte(out), &raw) != nil {
+		return
+	}
+	fp.MachineID = cleanID(raw.MachineID)
+	fp.DMIUUID = cleanID(raw.DMIUUID)
+	fp.Serial = cleanID(raw.Serial)
+}
+
+// primaryMAC retorna la MAC de la interfaz de la ruta por defecto, o si no
+// se puede saber, la de la primera interfaz física activa
+func primaryMAC() string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+
+	if name := defaultRouteInterface(); name != "" {
+		for _, iface := range ifaces {
+			if iface.Name == name && len(iface.HardwareAddr) > 0 {
+				return iface.HardwareAddr.String()
+			}
+		}
+	}
+
+	sort.Slice(ifaces, func(i, j int) bool { return ifaces[i].Index < ifaces[j].Index })
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || iface.Flags&net.FlagUp == 0 || len(iface.HardwareAddr) == 0 {
+			continue
+		}
+		return iface.HardwareAddr.String()
+	}
+	return ""
+}
+
+// defaultRouteInterface lee /proc/net/route; fuera de Linux retorna ""
+func defaultRouteInterface() string {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		// Iface Destination Gateway ...; destino 00000000 es la ruta por defecto
+		if len(fields) > 1 && fields[1] == "00000000" {
+			return fields[0]
+		}
+	}
+	return ""
+}
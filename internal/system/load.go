@@ -0,0 +1,70 @@
+package system
+
+import (
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+// CollectLoad retorna cifras básicas de carga. Es barato a propósito porque
+// se llama en cada heartbeat: en Linux lee /proc y en Windows llama a la API
+// del sistema en vez de lanzar PowerShell.
+func CollectLoad() models.Load {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	load := models.Load{
+		CPUs:          runtime.NumCPU(),
+		AgentMemoryMB: float64(ms.Sys) / 1024 / 1024,
+		Goroutines:    runtime.NumGoroutine(),
+	}
+
+	switch runtime.GOOS {
+	case "linux":
+		readLoadAvg(&load)
+		readMemInfo(&load)
+	case "windows":
+		readWindowsLoad(&load)
+	}
+	return load
+}
+
+func readLoadAvg(load *models.Load) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 3 {
+		return
+	}
+	load.Load1, _ = strconv.ParseFloat(fields[0], 64)
+	load.Load5, _ = strconv.ParseFloat(fields[1], 64)
+	load.Load15, _ = strconv.ParseFloat(fields[2], 64)
+}
+
+func readMemInfo(load *models.Load) {
+	data, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return
+	}
+	var total, available float64
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		switch fields[0] {
+		case "MemTotal:":
+			total, _ = strconv.ParseFloat(fields[1], 64)
+		case "MemAvailable:":
+			available, _ = strconv.ParseFloat(fields[1], 64)
+		}
+	}
+	if total > 0 {
+		load.MemoryUsedPercent = (total - available) / total * 100
+	}
+}
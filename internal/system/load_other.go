@@ -0,0 +1,7 @@
+//go:build !windows
+
+package system
+
+import "github.com/sentineledge/agent/pkg/models"
+
+func readWindowsLoad(load *models.Load) {}
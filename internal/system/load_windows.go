@@ -0,0 +1,69 @@
+package system
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/sentineledge/agent/pkg/models"
+)
+
+var (
+	kernel32                 = syscall.NewLazyDLL("kernel32.dll")
+	procGlobalMemoryStatusEx = kernel32.NewProc("GlobalMemoryStatusEx")
+	procGetSystemTimes       = kernel32.NewProc("GetSystemTimes")
+)
+
+// memoryStatusEx es MEMORYSTATUSEX de la API de Windows
+type memoryStatusEx struct {
+	length               uint32
+	memoryLoad           uint32
+	totalPhys            uint64
+	availPhys            uint64
+	totalPageFile        uint64
+	availPageFile        uint64
+	totalVirtual         uint64
+	availVirtual         uint64
+	availExtendedVirtual uint64
+}
+
+// Tiempos de CPU de la lectura anterior; el uso es la diferencia entre
+// dos heartbeats
+var (
+	cpuMu                  sync.Mutex
+	lastIdle, lastTotal    uint64
+	haveLastCPUMeasurement bool
+)
+
+func readWindowsLoad(load *models.Load) {
+	ms := memoryStatusEx{length: uint32(unsafe.Sizeof(memoryStatusEx{}))}
+	if r, _, _ := procGlobalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&ms))); r != 0 && ms.totalPhys > 0 {
+		load.MemoryUsedPercent = float64(ms.totalPhys-ms.availPhys) / float64(ms.totalPhys) * 100
+	}
+
+	var idle, kernel, user syscall.Filetime
+	r, _, _ := procGetSystemTimes.Call(
+		uintptr(unsafe.Pointer(&idle)),
+		uintptr(unsafe.Pointer(&kernel)),
+		uintptr(unsafe.Pointer(&user)),
+	)
+	if r == 0 {
+		return
+	}
+	// El tiempo de kernel incluye el idle
+	idleTicks := filetimeTicks(idle)
+	totalTicks := filetimeTicks(kernel) + filetimeTicks(user)
+
+	cpuMu.Lock()
+	defer cpuMu.Unlock()
+	if haveLastCPUMeasurement && totalTicks > lastTotal {
+		busy := (totalTicks - lastTotal) - (idleTicks - lastIdle)
+		load.CPUUsedPercent = float64(busy) / float64(totalTicks-lastTotal) * 100
+	}
+	lastIdle, lastTotal = idleTicks, totalTicks
+	haveLastCPUMeasurement = true
+}
+
+func filetimeTicks(ft syscall.Filetime) uint64 {
+	return uint64(ft.HighDateTime)<<32 | uint64(ft.LowDateTime)
+}
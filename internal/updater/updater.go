@@ -1,6 +1,7 @@
 package updater
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
@@ -9,6 +10,9 @@ import (
 	"os/exec"
 	"path/filepath"
 	"time"
+
+	"github.com/sentineledge/agent/internal/bandwidth"
+	"github.com/sentineledge/agent/internal/network"
 )
 
 const (
@@ -65,9 +69,25 @@ Start-Service "%s"
 	return nil
 }
 
+// Con el ancho de banda limitado la descarga puede tardar mucho más que
+// responder; el plazo corto es solo para que el servidor conteste
+const (
+	responseTimeout = 5 * time.Minute
+	downloadTimeout = 2 * time.Hour
+)
+
 func download(url, dest string) error {
-	client := &http.Client{Timeout: 5 * time.Minute}
-	resp, err := client.Get(url)
+	transport := network.TargetTransport(network.Updater)
+	transport.ResponseHeaderTimeout = responseTimeout
+	client := &http.Client{Transport: transport}
+
+	ctx, cancel := context.WithTimeout(context.Background(), downloadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return err
 	}
@@ -83,6 +103,6 @@ func download(url, dest string) error {
 	}
 	defer f.Close()
 
-	_, err = io.Copy(f, resp.Body)
+	_, err = io.Copy(f, bandwidth.Reader(ctx, resp.Body, bandwidth.Download))
 	return err
 }
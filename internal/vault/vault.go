@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/sentineledge/agent/internal/network"
 )
 
 type VaultClient struct {
@@ -31,6 +32,7 @@ type syncResponse struct {
 }
 
 type cipher struct {
+	ID    string `json:"id"`
 	Type  int    `json:"type"`
 	Name  string `json:"name"`
 	Login *login `json:"login"`
@@ -50,7 +52,10 @@ func NewClient(baseURL, clientID, clientSecret string) *VaultClient {
 		BaseURL:      baseURL,
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
-		httpClient:   &http.Client{Timeout: 10 * time.Second},
+		httpClient: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: network.TargetTransport(network.Vault),
+		},
 	}
 }
 
@@ -94,12 +99,27 @@ func (v *VaultClient) GetSecret(name string) (string, error) {
 		return "", err
 	}
 
+	c, err := v.findCipher(token, name)
+	if err != nil {
+		return "", err
+	}
+	if c == nil {
+		return "", fmt.Errorf("secret '%s' not found in vault", name)
+	}
+	if c.Login != nil && c.Login.Password != "" {
+		return c.Login.Password, nil
+	}
+	return c.Data.Password, nil
+}
+
+// findCipher busca un login con contraseña por nombre. Retorna nil si no existe.
+func (v *VaultClient) findCipher(token, name string) (*cipher, error) {
 	req, _ := http.NewRequest("GET", v.BaseURL+"/api/sync", nil)
 	req.Header.Set("Authorization", "Bearer "+token)
 
 	resp, err := v.httpClient.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("vault sync failed: %w", err)
+		return nil, fmt.Errorf("vault sync failed: %w", err)
 	}
 	defer resp.Body.Close()
 
@@ -107,22 +127,65 @@ func (v *VaultClient) GetSecret(name string) (string, error) {
 
 	var sync syncResponse
 	if err := json.Unmarshal(body, &sync); err != nil {
-		return "", fmt.Errorf("vault sync parse error: %w", err)
+		return nil, fmt.Errorf("vault sync parse error: %w", err)
 	}
 
 	for _, c := range sync.Ciphers {
 		if c.Type != 1 || c.Name != name {
 			continue
 		}
-		if c.Login != nil && c.Login.Password != "" {
-			return c.Login.Password, nil
-		}
-		if c.Data != nil && c.Data.Password != "" {
-			return c.Data.Password, nil
+		if (c.Login != nil && c.Login.Password != "") || (c.Data != nil && c.Data.Password != "") {
+			return &c, nil
 		}
 	}
 
-	return "", fmt.Errorf("secret '%s' not found in vault", name)
+	return nil, nil
+}
+
+// UpdateSecret reemplaza el valor de un secreto existente con un solo PUT,
+// así nunca hay dos versiones con el mismo nombre. Si no existe lo crea.
+func (v *VaultClient) UpdateSecret(name, value, orgID, collectionID string) error {
+	token, err := v.getToken()
+	if err != nil {
+		return err
+	}
+
+	c, err := v.findCipher(token, name)
+	if err != nil {
+		return err
+	}
+	if c == nil {
+		return v.StoreSecret(name, value, orgID, collectionID)
+	}
+
+	body := map[string]interface{}{
+		"organizationId": orgID,
+		"type":           1,
+		"name":           name,
+		"login": map[string]interface{}{
+			"username": name,
+			"password": value,
+			"uris":     []string{},
+		},
+	}
+
+	jsonBody, _ := json.Marshal(body)
+	req, _ := http.NewRequest("PUT", v.BaseURL+"/api/ciphers/"+c.ID, strings.NewReader(string(jsonBody)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := v.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault update failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("vault update error %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	return nil
 }
 
 func (v *VaultClient) StoreSecret(name, value, orgID, collectionID string) error {
@@ -0,0 +1,11 @@
+package version
+
+// Version es la versión del agente. Subirla en cada release; un build
+// puede sobrescribirla al compilar:
+//
+//	go build -ldflags "-X github.com/sentineledge/agent/internal/version.Version=1.4.0"
+var Version = "0.1.0"
+
+// ProtocolVersion es la versión del protocolo agente-servidor que este
+// binario implementa. Subirla cuando cambie algún contrato con la API.
+const ProtocolVersion = 2
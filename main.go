@@ -1,24 +1,46 @@
 package main
 
 import (
+	"context"
 	"log"
 	"os"
+	"time"
 
 	"github.com/kardianos/service"
 	"github.com/sentineledge/agent/internal/agent"
 )
 
+// Tiempo que Stop espera a que el agente cancele lo que tenga en curso
+const stopTimeout = 10 * time.Second
+
 type program struct {
-	agent *agent.Agent
+	agent  *agent.Agent
+	cancel context.CancelFunc
+	done   chan struct{}
 }
 
 func (p *program) Start(s service.Service) error {
-	go p.agent.Run()
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.done = make(chan struct{})
+	go func() {
+		defer close(p.done)
+		p.agent.Run(ctx)
+	}()
 	return nil
 }
 
 func (p *program) Stop(s service.Service) error {
 	log.Println("Stoppping SentinelEdge Agent...")
+	if p.cancel == nil {
+		return nil
+	}
+	p.cancel()
+	select {
+	case <-p.done:
+	case <-time.After(stopTimeout):
+		log.Println("Agent did not stop in time")
+	}
 	return nil
 }
 
@@ -30,6 +52,15 @@ func main() {
 	}
 
 	cfg := agent.LoadConfig()
+
+	// diagnose solo prueba la red; no necesita armar el agente
+	if len(os.Args) > 1 && os.Args[1] == "diagnose" {
+		if !agent.Diagnose(cfg) {
+			os.Exit(1)
+		}
+		return
+	}
+
 	a := agent.New(cfg)
 	prg := &program{agent: a}
 
@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+type Load struct {
+	CPUs              int     `json:"cpus"`
+	Load1             float64 `json:"load1,omitempty"`
+	Load5             float64 `json:"load5,omitempty"`
+	Load15            float64 `json:"load15,omitempty"`
+	MemoryUsedPercent float64 `json:"memory_used_percent,omitempty"`
+	CPUUsedPercent    float64 `json:"cpu_used_percent,omitempty"` // desde el heartbeat anterior; Windows no tiene load average
+	AgentMemoryMB     float64 `json:"agent_memory_mb"`
+	Goroutines        int     `json:"goroutines"`
+}
+
+type Heartbeat struct {
+	AgentID         string        `json:"agent_id"`
+	Version         string        `json:"version"`
+	UptimeSeconds   int64         `json:"uptime_seconds"`
+	RunningJobs     []string      `json:"running_jobs"`
+	QueuedJobs      []string      `json:"queued_jobs"`
+	LastPollAt      *time.Time    `json:"last_poll_at,omitempty"`
+	LastInventoryAt *time.Time    `json:"last_inventory_at,omitempty"`
+	OutboxDepth     int           `json:"outbox_depth"`
+	ActiveEndpoint  string        `json:"active_endpoint"`
+	Capabilities    *Capabilities `json:"capabilities,omitempty"`
+	Load            Load          `json:"load"`
+	SentAt          time.Time     `json:"sent_at"` // corregida con el desfase estimado del reloj
+	SentAtLocal     time.Time     `json:"sent_at_local"`
+	// ClockSkewMillis es cuánto atrasa (negativo: adelanta) el reloj del
+	// equipo respecto del servidor; nil si todavía no hay estimación
+	ClockSkewMillis *int64 `json:"clock_skew_ms,omitempty"`
+	ClockSkewAlert  bool   `json:"clock_skew_alert,omitempty"` // el desfase supera el umbral configurado
+	Metered         bool   `json:"metered,omitempty"`          // enlace medido: transferencias no urgentes postergadas
+}
+
+// HeartbeatResponse trae directivas opcionales del servidor
+type HeartbeatResponse struct {
+	PollInterval     int   `json:"poll_interval,omitempty"`     // nuevo intervalo de poll en segundos
+	CollectInventory bool  `json:"collect_inventory,omitempty"` // pide inventario inmediato
+	Metered          *bool `json:"metered,omitempty"`           // marca o desmarca el enlace como medido
+}
@@ -1,6 +1,9 @@
 package models
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type Agent struct {
 	ID       string `json:"id"`
@@ -20,11 +23,53 @@ type Command struct {
 }
 
 type Result struct {
-	JobID      string    `json:"job_id"`
-	AgentID    string    `json:"agent_id"`
-	ExitCode   int       `json:"exit_code"`
-	Stdout     string    `json:"stdout"`
-	Stderr     string    `json:"stderr"`
-	Error      string    `json:"error,omitempty"`
-	FinishedAt time.Time `json:"finished_at"`
+	JobID           string          `json:"job_id"`
+	AgentID         string          `json:"agent_id"`
+	ExitCode        int             `json:"exit_code"`
+	Stdout          string          `json:"stdout"`
+	StdoutEncoding  string          `json:"stdout_encoding,omitempty"` // "base64" si la salida no era texto
+	Stderr          string          `json:"stderr"`
+	StderrEncoding  string          `json:"stderr_encoding,omitempty"`
+	Error           string          `json:"error,omitempty"`
+	Data            json.RawMessage `json:"data,omitempty"` // JSON escrito por el script en SE_OUTPUT_FILE
+	DataError       string          `json:"data_error,omitempty"`
+	Artifacts       []string        `json:"artifacts,omitempty"` // archivos de SE_ARTIFACTS_DIR subidos al servidor
+	FinishedAt      time.Time       `json:"finished_at"`         // corregida con el desfase estimado del reloj
+	FinishedAtLocal time.Time       `json:"finished_at_local"`   // según el reloj del equipo
+
+	// DeferredArtifacts son los archivos de SE_ARTIFACTS_DIR que se subirán
+	// cuando el enlace deje de ser medido
+	DeferredArtifacts []string `json:"deferred_artifacts,omitempty"`
+}
+
+// Progress es un evento de avance reportado por un job en ejecución
+type Progress struct {
+	JobID   string    `json:"job_id"`
+	Percent int       `json:"percent"` // -1 si el script no ha reportado porcentaje
+	Message string    `json:"message,omitempty"`
+	At      time.Time `json:"at"`       // corregida con el desfase estimado del reloj
+	AtLocal time.Time `json:"at_local"` // según el reloj del equipo
+}
+
+// Capabilities describe qué soporta este agente; va en el registro y en
+// cada heartbeat para que el servidor no envíe lo que no puede ejecutar
+type Capabilities struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	AgentVersion    string   `json:"agent_version"`
+	OS              string   `json:"os"`
+	Arch            string   `json:"arch"`
+	CommandTypes    []string `json:"command_types"`
+	Transports      []string `json:"transports"`
+	Features        []string `json:"features"`
+}
+
+// Fingerprint identifica la máquina para que el servidor reconozca un
+// equipo ya registrado aunque se haya reinstalado el agente. Los campos
+// que el sistema no expone quedan vacíos.
+type Fingerprint struct {
+	ID        string `json:"id"` // SHA-256 de los demás campos
+	MachineID string `json:"machine_id,omitempty"`
+	DMIUUID   string `json:"dmi_uuid,omitempty"`
+	Serial    string `json:"serial,omitempty"`
+	MACHash   string `json:"mac_hash,omitempty"` // SHA-256 de la MAC de la interfaz principal
 }